@@ -0,0 +1,424 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package opts
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/fs"
+	"github.com/golang/glog"
+	"github.com/opencontainers/runc/libcontainer/user"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// RootfsOpt updates the spec with the container rootfs, and is applied with WithRootfs,
+// so that the rootfs is mounted at most once for all of them.
+type RootfsOpt struct {
+	// Required is whether the option needs the rootfs.
+	Required bool
+	// Apply updates the spec. root is the mounted rootfs, which is empty if no
+	// option requires the rootfs.
+	Apply func(root string, c *containers.Container, s *runtimespec.Spec) error
+}
+
+// WithRootfs applies the rootfs options in order. The container rootfs is mounted
+// once for all options if any of them requires it, and not mounted at all otherwise.
+func WithRootfs(opts ...RootfsOpt) containerd.SpecOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container, s *runtimespec.Spec) error {
+		for _, o := range opts {
+			if o.Required {
+				return withRootfs(ctx, client, c, func(root string) error {
+					return applyRootfsOpts(root, c, s, opts)
+				})
+			}
+		}
+		return applyRootfsOpts("", c, s, opts)
+	}
+}
+
+// applyRootfsOpts applies the rootfs options with the rootfs mounted at root.
+func applyRootfsOpts(root string, c *containers.Container, s *runtimespec.Spec, opts []RootfsOpt) error {
+	for _, o := range opts {
+		if err := o.Apply(root, c, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithUser sets the user and the primary group of the container process. The
+// user string is in the same format with docker: "user[:group]", both user and
+// group could be either numeric id or name. Names are resolved against
+// /etc/passwd and /etc/group in the container rootfs, and an error is returned
+// if a name can't be resolved. A numeric user doesn't need the rootfs, it is used
+// as the uid directly like runc and docker, with the gid if given. Otherwise the
+// gid is 0, or the primary group in /etc/passwd if the rootfs is mounted for other
+// options and the uid is found there.
+func WithUser(userstr string) RootfsOpt {
+	if uid, gid, ok := parseNumericUser(userstr); ok {
+		return RootfsOpt{Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+			s.Process.User.UID = uid
+			s.Process.User.GID = gid
+			return nil
+		}}
+	}
+	if uid, err := strconv.ParseUint(userstr, 10, 32); err == nil {
+		return RootfsOpt{Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+			s.Process.User.UID, s.Process.User.GID = uint32(uid), 0
+			if root == "" {
+				return nil
+			}
+			gid, err := lookupPrimaryGroup(root, uint32(uid))
+			if err != nil {
+				return err
+			}
+			s.Process.User.GID = gid
+			return nil
+		}}
+	}
+	return RootfsOpt{Required: true, Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+		uid, gid, err := resolveUser(root, userstr)
+		if err != nil {
+			return err
+		}
+		s.Process.User.UID = uid
+		s.Process.User.GID = gid
+		return nil
+	}}
+}
+
+// lookupPrimaryGroup returns the primary gid of the uid in /etc/passwd in the rootfs,
+// which is 0 if /etc/passwd doesn't exist or the uid is not found.
+func lookupPrimaryGroup(root string, uid uint32) (uint32, error) {
+	passwdPath, err := fs.RootPath(root, "/etc/passwd")
+	if err != nil {
+		return 0, err
+	}
+	users, err := user.ParsePasswdFileFilter(passwdPath, func(u user.User) bool {
+		return u.Uid == int(uid)
+	})
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to read %q", "/etc/passwd")
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+	return uint32(users[0].Gid), nil
+}
+
+// resolveUser resolves the uid and gid of the user string against /etc/passwd and
+// /etc/group in the rootfs.
+func resolveUser(root, userstr string) (uint32, uint32, error) {
+	passwdPath, err := fs.RootPath(root, "/etc/passwd")
+	if err != nil {
+		return 0, 0, err
+	}
+	groupPath, err := fs.RootPath(root, "/etc/group")
+	if err != nil {
+		return 0, 0, err
+	}
+	execUser, err := user.GetExecUserPath(userstr, nil, passwdPath, groupPath)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to resolve user %q", userstr)
+	}
+	return uint32(execUser.Uid), uint32(execUser.Gid), nil
+}
+
+// WithAdditionalGroups adds supplementary groups of the container process. Groups
+// could be either numeric id or name, and names are resolved against /etc/group in
+// the container rootfs. An error is returned if a name can't be resolved.
+func WithAdditionalGroups(groups []string) RootfsOpt {
+	return RootfsOpt{Required: true, Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+		gids, err := resolveAdditionalGroups(root, groups)
+		if err != nil {
+			return err
+		}
+		s.Process.User.AdditionalGids = append(s.Process.User.AdditionalGids, gids...)
+		return nil
+	}}
+}
+
+// resolveAdditionalGroups resolves the gids of the groups against /etc/group in the
+// rootfs.
+func resolveAdditionalGroups(root string, groups []string) ([]uint32, error) {
+	groupPath, err := fs.RootPath(root, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	gids, err := user.GetAdditionalGroupsPath(groups, groupPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve supplementary groups %v", groups)
+	}
+	var result []uint32
+	for _, gid := range gids {
+		result = append(result, uint32(gid))
+	}
+	return result, nil
+}
+
+// WithWorkingDirCheck checks whether the working directory of the container process
+// exists in the container rootfs, and logs a warning if it doesn't. The container is
+// still created, because the runtime creates the missing working directory.
+func WithWorkingDirCheck() RootfsOpt {
+	return RootfsOpt{Required: true, Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+		p, err := fs.RootPath(root, s.Process.Cwd)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			glog.Warningf("Working directory %q of container %q does not exist in the image",
+				s.Process.Cwd, c.ID)
+		}
+		return nil
+	}}
+}
+
+// WithOverlayVolumes mounts image volumes as overlay, so that they are writable
+// without copying the image content. volumes maps volume container paths to host
+// directories, where the upper and work directories of the overlay are created.
+// The lower layers are the volume paths in the image layers, so it only works with
+// the overlayfs snapshotter. Opaque directories in the image layers above the volume
+// path are not honored. Volumes without image content are kept as bind mounts.
+func WithOverlayVolumes(volumes map[string]string) containerd.SpecOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container, s *runtimespec.Spec) error {
+		if c.Snapshotter == "" || c.SnapshotKey == "" {
+			return errors.Errorf("rootfs not created for container")
+		}
+		mounts, err := client.SnapshotService(c.Snapshotter).Mounts(ctx, c.SnapshotKey)
+		if err != nil {
+			return err
+		}
+		if len(mounts) != 1 || mounts[0].Type != "overlay" {
+			return errors.Errorf("overlay image volumes require overlay rootfs")
+		}
+		var lowers []string
+		for _, o := range mounts[0].Options {
+			if strings.HasPrefix(o, "lowerdir=") {
+				lowers = strings.Split(strings.TrimPrefix(o, "lowerdir="), ":")
+			}
+		}
+		return overlayVolumes(s, lowers, volumes)
+	}
+}
+
+// overlayVolumes replaces the volume mounts in the spec with overlay mounts on the
+// volume paths in the lower layers.
+func overlayVolumes(s *runtimespec.Spec, lowers []string, volumes map[string]string) error {
+	for i, m := range s.Mounts {
+		dir, ok := volumes[m.Destination]
+		if !ok {
+			continue
+		}
+		var volumeLowers []string
+		for _, l := range lowers {
+			p, err := fs.RootPath(l, m.Destination)
+			if err != nil {
+				return err
+			}
+			if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+				volumeLowers = append(volumeLowers, p)
+			}
+		}
+		if len(volumeLowers) == 0 {
+			continue
+		}
+		upper, work := filepath.Join(dir, "upper"), filepath.Join(dir, "work")
+		for _, d := range []string{upper, work} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return errors.Wrapf(err, "failed to create overlay directory %q", d)
+			}
+		}
+		s.Mounts[i] = runtimespec.Mount{
+			Destination: m.Destination,
+			Type:        "overlay",
+			Source:      "overlay",
+			Options: []string{
+				"lowerdir=" + strings.Join(volumeLowers, ":"),
+				"upperdir=" + upper,
+				"workdir=" + work,
+			},
+		}
+	}
+	return nil
+}
+
+// parseNumericUser parses user string in "uid:gid" format, and returns false if
+// either part is missing or not numeric.
+func parseNumericUser(userstr string) (uint32, uint32, bool) {
+	parts := strings.SplitN(userstr, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	uid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	gid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return uint32(uid), uint32(gid), true
+}
+
+// WithUserMappingCheck checks whether the user, the primary group and the supplementary
+// groups of the container process are mapped in the user namespace of the container, so
+// that an unmapped id is reported at creation instead of as an obscure error at start.
+// It should be applied after the user is set. Nothing is checked without id mappings.
+func WithUserMappingCheck() containerd.SpecOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container, s *runtimespec.Spec) error {
+		return checkUserMapping(s)
+	}
+}
+
+// checkUserMapping checks the process user and groups against the id mappings.
+func checkUserMapping(s *runtimespec.Spec) error {
+	if s.Linux == nil || (len(s.Linux.UIDMappings) == 0 && len(s.Linux.GIDMappings) == 0) {
+		return nil
+	}
+	u := s.Process.User
+	if !isIDMapped(u.UID, s.Linux.UIDMappings) {
+		return errors.Errorf("uid %d is not mapped in the container user namespace", u.UID)
+	}
+	if !isIDMapped(u.GID, s.Linux.GIDMappings) {
+		return errors.Errorf("gid %d is not mapped in the container user namespace", u.GID)
+	}
+	for _, gid := range u.AdditionalGids {
+		if !isIDMapped(gid, s.Linux.GIDMappings) {
+			return errors.Errorf("supplementary gid %d is not mapped in the container user namespace", gid)
+		}
+	}
+	return nil
+}
+
+// isIDMapped returns whether the container id is in any of the mappings.
+func isIDMapped(id uint32, mappings []runtimespec.LinuxIDMapping) bool {
+	for _, m := range mappings {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxEntrypointFileSize is the max size of the entrypoint file.
+const maxEntrypointFileSize = 4096
+
+// WithEntrypointFromFile sets the container process to the command read from the
+// file inside the container rootfs, followed by args. The command is split by
+// whitespaces without any shell interpolation. The path is resolved within the
+// rootfs, and only regular files up to maxEntrypointFileSize are read.
+func WithEntrypointFromFile(path string, args []string) RootfsOpt {
+	return RootfsOpt{Required: true, Apply: func(root string, c *containers.Container, s *runtimespec.Spec) error {
+		command, err := readEntrypointFile(root, path)
+		if err != nil {
+			return err
+		}
+		s.Process.Args = append(command, args...)
+		return nil
+	}}
+}
+
+// readEntrypointFile reads the command from the entrypoint file in the rootfs.
+func readEntrypointFile(root, path string) ([]string, error) {
+	p, err := fs.RootPath(root, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open entrypoint file %q", path)
+	}
+	defer f.Close() // nolint: errcheck
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat entrypoint file %q", path)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errors.Errorf("entrypoint file %q is not a regular file", path)
+	}
+	if fi.Size() > maxEntrypointFileSize {
+		return nil, errors.Errorf("entrypoint file %q size %d exceeds the limit %d",
+			path, fi.Size(), maxEntrypointFileSize)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxEntrypointFileSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read entrypoint file %q", path)
+	}
+	command := strings.Fields(string(data))
+	if len(command) == 0 {
+		return nil, errors.Errorf("entrypoint file %q is empty", path)
+	}
+	return command, nil
+}
+
+// withRootfs mounts the container rootfs snapshot into a temporary directory,
+// and calls f with the directory. The rootfs is unmounted after f returns, and an
+// error is returned if it can't be unmounted.
+func withRootfs(ctx context.Context, client *containerd.Client, c *containers.Container, f func(root string) error) (retErr error) {
+	if c.Snapshotter == "" {
+		return errors.Errorf("no snapshotter set for container")
+	}
+	if c.SnapshotKey == "" {
+		return errors.Errorf("rootfs not created for container")
+	}
+	snapshotter := client.SnapshotService(c.Snapshotter)
+	mounts, err := snapshotter.Mounts(ctx, c.SnapshotKey)
+	if err != nil {
+		return err
+	}
+	root, err := ioutil.TempDir("", "ctd-rootfs")
+	if err != nil {
+		return err
+	}
+	mounted := 0
+	defer func() {
+		// Unmount in the reverse order, and never remove the directory while
+		// anything is still mounted on it, which would delete the snapshot content.
+		for ; mounted > 0; mounted-- {
+			if err := unix.Unmount(root, 0); err != nil {
+				glog.Errorf("Failed to unmount container rootfs %q, leaving it in place: %v", root, err)
+				if retErr == nil {
+					retErr = errors.Wrapf(err, "failed to unmount container rootfs %q", root)
+				}
+				return
+			}
+		}
+		if err := os.Remove(root); err != nil {
+			glog.Errorf("Failed to remove container rootfs directory %q: %v", root, err)
+		}
+	}()
+	for _, m := range mounts {
+		if err := m.Mount(root); err != nil {
+			return err
+		}
+		mounted++
+	}
+	return f(root)
+}
@@ -0,0 +1,401 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package opts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/containers"
+	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// newFakeRootfs creates a temporary rootfs with the files, keyed by the path
+// relative to the rootfs. The caller should remove the returned directory.
+func newFakeRootfs(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "test-rootfs")
+	require.NoError(t, err)
+	for p, content := range files {
+		p = filepath.Join(root, p)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	return root
+}
+
+func TestResolveUser(t *testing.T) {
+	root := newFakeRootfs(t, map[string]string{
+		"etc/passwd": "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534:nobody:/:/bin/false\n",
+		"etc/group":  "root:x:0:\nstaff:x:50:\nnogroup:x:65534:\n",
+	})
+	defer os.RemoveAll(root)
+	for desc, test := range map[string]struct {
+		user        string
+		expectedUID uint32
+		expectedGID uint32
+		expectErr   bool
+	}{
+		"should resolve user name with its primary group": {
+			user:        "nobody",
+			expectedUID: 65534,
+			expectedGID: 65534,
+		},
+		"should resolve user name and group name": {
+			user:        "nobody:staff",
+			expectedUID: 65534,
+			expectedGID: 50,
+		},
+		"should resolve uid in passwd with its primary group": {
+			user:        "65534",
+			expectedUID: 65534,
+			expectedGID: 65534,
+		},
+		"should use uid not in passwd with gid 0": {
+			user:        "1000",
+			expectedUID: 1000,
+		},
+		"should resolve uid and group name": {
+			user:        "1000:staff",
+			expectedUID: 1000,
+			expectedGID: 50,
+		},
+		"should return error for unknown user name": {
+			user:      "unknown",
+			expectErr: true,
+		},
+		"should return error for unknown group name": {
+			user:      "nobody:unknown",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		uid, gid, err := resolveUser(root, test.user)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedUID, uid)
+		assert.Equal(t, test.expectedGID, gid)
+	}
+}
+
+func TestResolveUserWithoutPasswd(t *testing.T) {
+	root := newFakeRootfs(t, nil)
+	defer os.RemoveAll(root)
+
+	uid, gid, err := resolveUser(root, "1000")
+	require.NoError(t, err, "numeric user should not require passwd")
+	assert.EqualValues(t, 1000, uid)
+	assert.EqualValues(t, 0, gid)
+
+	_, _, err = resolveUser(root, "nobody")
+	assert.Error(t, err, "user name should require passwd")
+}
+
+func TestReadEntrypointFile(t *testing.T) {
+	root := newFakeRootfs(t, map[string]string{
+		"entrypoint":   "/bin/app  --flag\n\t$HOME\n",
+		"empty":        " \n",
+		"large":        strings.Repeat("a", maxEntrypointFileSize+1),
+		"etc/hostname": "test\n",
+	})
+	defer os.RemoveAll(root)
+	require.NoError(t, os.Symlink("/entrypoint", filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink("../../../../../entrypoint", filepath.Join(root, "escape")))
+	for desc, test := range map[string]struct {
+		path      string
+		expected  []string
+		expectErr bool
+	}{
+		"should split the command by whitespaces without interpolation": {
+			path:     "/entrypoint",
+			expected: []string{"/bin/app", "--flag", "$HOME"},
+		},
+		"should resolve symlink within the rootfs": {
+			path:     "/link",
+			expected: []string{"/bin/app", "--flag", "$HOME"},
+		},
+		"should not escape the rootfs": {
+			path:     "/escape",
+			expected: []string{"/bin/app", "--flag", "$HOME"},
+		},
+		"should return error for empty file": {
+			path:      "/empty",
+			expectErr: true,
+		},
+		"should return error for file over the size limit": {
+			path:      "/large",
+			expectErr: true,
+		},
+		"should return error for directory": {
+			path:      "/etc",
+			expectErr: true,
+		},
+		"should return error for missing file": {
+			path:      "/missing",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		command, err := readEntrypointFile(root, test.path)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, command)
+	}
+}
+
+func TestParseNumericUser(t *testing.T) {
+	for desc, test := range map[string]struct {
+		user        string
+		expectedUID uint32
+		expectedGID uint32
+		expectedOK  bool
+	}{
+		"should parse uid:gid": {
+			user:        "1000:50",
+			expectedUID: 1000,
+			expectedGID: 50,
+			expectedOK:  true,
+		},
+		"should not parse uid only": {
+			user: "1000",
+		},
+		"should not parse user name": {
+			user: "nobody:50",
+		},
+		"should not parse group name": {
+			user: "1000:staff",
+		},
+		"should not parse empty gid": {
+			user: "1000:",
+		},
+		"should not parse uid out of range": {
+			user: "4294967296:0",
+		},
+		"should not parse negative gid": {
+			user: "0:-1",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		uid, gid, ok := parseNumericUser(test.user)
+		assert.Equal(t, test.expectedOK, ok)
+		assert.Equal(t, test.expectedUID, uid)
+		assert.Equal(t, test.expectedGID, gid)
+	}
+}
+
+func TestWithNumericUser(t *testing.T) {
+	for desc, test := range map[string]struct {
+		user     string
+		expected runtimespec.User
+	}{
+		"should set uid:gid": {
+			user:     "1000:50",
+			expected: runtimespec.User{UID: 1000, GID: 50},
+		},
+		"should set uid with gid 0": {
+			user:     "1000",
+			expected: runtimespec.User{UID: 1000},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{Process: &runtimespec.Process{}}
+		// The container has no rootfs, so the user must be set without mounting it.
+		err := WithRootfs(WithUser(test.user))(context.Background(), nil, &containers.Container{}, spec)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Process.User)
+	}
+
+	spec := &runtimespec.Spec{Process: &runtimespec.Process{}}
+	err := WithRootfs(WithUser("nobody"))(context.Background(), nil, &containers.Container{}, spec)
+	assert.Error(t, err, "user name should require the rootfs")
+}
+
+func TestNumericUserWithMountedRootfs(t *testing.T) {
+	root := newFakeRootfs(t, map[string]string{
+		"etc/passwd": "nobody:x:65534:65534:nobody:/:/bin/false\n",
+	})
+	defer os.RemoveAll(root)
+	noPasswd := newFakeRootfs(t, nil)
+	defer os.RemoveAll(noPasswd)
+	for desc, test := range map[string]struct {
+		root     string
+		user     string
+		expected runtimespec.User
+	}{
+		"should use the primary group of uid in passwd": {
+			root:     root,
+			user:     "65534",
+			expected: runtimespec.User{UID: 65534, GID: 65534},
+		},
+		"should use gid 0 for uid not in passwd": {
+			root:     root,
+			user:     "1000",
+			expected: runtimespec.User{UID: 1000},
+		},
+		"should use gid 0 without passwd": {
+			root:     noPasswd,
+			user:     "65534",
+			expected: runtimespec.User{UID: 65534},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{Process: &runtimespec.Process{}}
+		require.NoError(t, applyRootfsOpts(test.root, &containers.Container{}, spec, []RootfsOpt{WithUser(test.user)}))
+		assert.Equal(t, test.expected, spec.Process.User)
+	}
+}
+
+func TestResolveAdditionalGroups(t *testing.T) {
+	root := newFakeRootfs(t, map[string]string{
+		"etc/group": "root:x:0:\nstaff:x:50:\nvideo:x:44:\n",
+	})
+	defer os.RemoveAll(root)
+	for desc, test := range map[string]struct {
+		groups    []string
+		expected  []uint32
+		expectErr bool
+	}{
+		"should resolve group names": {
+			groups:   []string{"staff", "video"},
+			expected: []uint32{44, 50},
+		},
+		"should use numeric gid not in group file": {
+			groups:   []string{"1000", "staff"},
+			expected: []uint32{50, 1000},
+		},
+		"should return error for unknown group name": {
+			groups:    []string{"staff", "unknown"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		gids, err := resolveAdditionalGroups(root, test.groups)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		// The resolved gids are not ordered.
+		sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+		assert.Equal(t, test.expected, gids)
+	}
+}
+
+func TestOverlayVolumes(t *testing.T) {
+	upperLayer := newFakeRootfs(t, map[string]string{"data/b": "b"})
+	defer os.RemoveAll(upperLayer)
+	lowerLayer := newFakeRootfs(t, map[string]string{"data/a": "a", "cache/c": "c"})
+	defer os.RemoveAll(lowerLayer)
+	volumesDir, err := ioutil.TempDir("", "test-volumes")
+	require.NoError(t, err)
+	defer os.RemoveAll(volumesDir)
+
+	bind := func(dest string) runtimespec.Mount {
+		return runtimespec.Mount{Destination: dest, Type: "bind", Source: filepath.Join(volumesDir, dest)}
+	}
+	spec := &runtimespec.Spec{Mounts: []runtimespec.Mount{bind("/data"), bind("/empty"), bind("/other"), bind("/cache")}}
+	volumes := map[string]string{
+		"/data":  filepath.Join(volumesDir, "data"),
+		"/empty": filepath.Join(volumesDir, "empty"),
+		"/cache": filepath.Join(volumesDir, "cache"),
+	}
+	require.NoError(t, overlayVolumes(spec, []string{upperLayer, lowerLayer}, volumes))
+
+	dataDir := filepath.Join(volumesDir, "data")
+	assert.Equal(t, runtimespec.Mount{
+		Destination: "/data",
+		Type:        "overlay",
+		Source:      "overlay",
+		Options: []string{
+			"lowerdir=" + filepath.Join(upperLayer, "data") + ":" + filepath.Join(lowerLayer, "data"),
+			"upperdir=" + filepath.Join(dataDir, "upper"),
+			"workdir=" + filepath.Join(dataDir, "work"),
+		},
+	}, spec.Mounts[0], "should overlay volume on the layers with its content in order")
+	for _, d := range []string{"upper", "work"} {
+		fi, err := os.Stat(filepath.Join(dataDir, d))
+		require.NoError(t, err)
+		assert.True(t, fi.IsDir())
+	}
+	assert.Equal(t, bind("/empty"), spec.Mounts[1], "should keep volume without image content as bind mount")
+	assert.Equal(t, bind("/other"), spec.Mounts[2], "should not change mount which is not a volume")
+	assert.Equal(t, []string{"lowerdir=" + filepath.Join(lowerLayer, "cache")}, spec.Mounts[3].Options[:1],
+		"should only use layers with the volume content")
+}
+
+func TestCheckUserMapping(t *testing.T) {
+	keepID := &runtimespec.Linux{
+		UIDMappings: []runtimespec.LinuxIDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+		GIDMappings: []runtimespec.LinuxIDMapping{{HostID: 1000, ContainerID: 0, Size: 1}},
+	}
+	for desc, test := range map[string]struct {
+		linux     *runtimespec.Linux
+		user      runtimespec.User
+		expectErr bool
+	}{
+		"should accept any user without id mappings": {
+			linux: &runtimespec.Linux{},
+			user:  runtimespec.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{50}},
+		},
+		"should accept mapped root": {
+			linux: keepID,
+		},
+		"should accept ids in a mapping range": {
+			linux: &runtimespec.Linux{
+				UIDMappings: []runtimespec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+				GIDMappings: []runtimespec.LinuxIDMapping{{HostID: 100000, ContainerID: 0, Size: 65536}},
+			},
+			user: runtimespec.User{UID: 65535, GID: 1000, AdditionalGids: []uint32{50}},
+		},
+		"should reject unmapped uid": {
+			linux:     keepID,
+			user:      runtimespec.User{UID: 1000},
+			expectErr: true,
+		},
+		"should reject unmapped gid": {
+			linux:     keepID,
+			user:      runtimespec.User{GID: 1000},
+			expectErr: true,
+		},
+		"should reject unmapped supplementary gid": {
+			linux:     keepID,
+			user:      runtimespec.User{AdditionalGids: []uint32{0, 50}},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{Process: &runtimespec.Process{User: test.user}, Linux: test.linux}
+		err := checkUserMapping(spec)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
@@ -17,8 +17,14 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/containerd/containerd"
 	"github.com/golang/glog"
@@ -43,8 +49,10 @@ func (c *criContainerdService) Attach(ctx context.Context, r *runtime.AttachRequ
 	return c.streamServer.GetAttach(r)
 }
 
+// attachContainer attaches to the container io. If detachKeys is not empty, the session
+// is detached when the key sequence is read from stdin, leaving the container running.
 func (c *criContainerdService) attachContainer(ctx context.Context, id string, stdin io.Reader, stdout, stderr io.WriteCloser,
-	tty bool, resize <-chan remotecommand.TerminalSize) error {
+	tty bool, resize <-chan remotecommand.TerminalSize, detachKeys []byte) error {
 	// Get container from our container store.
 	cntr, err := c.containerStore.Get(id)
 	if err != nil {
@@ -67,6 +75,13 @@ func (c *criContainerdService) attachContainer(ctx context.Context, id string, s
 		}
 	})
 
+	var detach *detachReader
+	// A non-tty session with StdinOnce ends with the client stdin, which also closes
+	// the container stdin, so it can't be detached.
+	if stdin != nil && len(detachKeys) > 0 && (tty || !cntr.Config.StdinOnce) {
+		detach = newDetachReader(stdin, detachKeys)
+		stdin = detach
+	}
 	opts := cio.AttachOptions{
 		Stdin:     stdin,
 		Stdout:    stdout,
@@ -74,12 +89,270 @@ func (c *criContainerdService) attachContainer(ctx context.Context, id string, s
 		Tty:       tty,
 		StdinOnce: cntr.Config.StdinOnce,
 		CloseStdin: func() error {
+			if detach != nil && detach.isDetached() {
+				// Do not close container stdin when the session is detached.
+				glog.V(2).Infof("Detached from container %q", id)
+				return nil
+			}
 			return task.CloseIO(ctx, containerd.WithStdinCloser)
 		},
 	}
-	// TODO(random-liu): Figure out whether we need to support historical output.
-	if err := cntr.IO.Attach(opts); err != nil {
+	// Replay the recent output from the container log, so that a client re-attaching
+	// doesn't miss the output produced in between. This is best effort, output
+	// produced while replaying could be missed or duplicated.
+	if lines := c.config.AttachReplayLines; lines > 0 && cntr.Metadata.LogPath != "" {
+		if err := replayLogTail(cntr.Metadata.LogPath, lines, stdout, stderr, tty); err != nil {
+			glog.Warningf("Failed to replay log of container %q: %v", id, err)
+		}
+	}
+	if err := attachIO(cntr.IO.Attach, opts, detach); err != nil {
 		return fmt.Errorf("failed to attach container: %v", err)
 	}
 	return nil
 }
+
+// attachIO attaches the streams with attach, and returns once attach returns. On
+// detach, the output writers stop forwarding to the client at once, and stdin returns
+// io.EOF, which makes the container io remove the output streams and end the attach,
+// while the container keeps running. StdinOnce must not be set with detach, otherwise
+// the container io keeps the output streams after stdin ends.
+func attachIO(attach func(cio.AttachOptions) error, opts cio.AttachOptions, detach *detachReader) error {
+	if detach == nil {
+		return attach(opts)
+	}
+	var writers []*detachableWriter
+	if opts.Stdout != nil {
+		w := &detachableWriter{w: opts.Stdout}
+		writers = append(writers, w)
+		opts.Stdout = w
+	}
+	if opts.Stderr != nil {
+		w := &detachableWriter{w: opts.Stderr}
+		writers = append(writers, w)
+		opts.Stderr = w
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- attach(opts)
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-detach.detached:
+		for _, w := range writers {
+			w.Close() // nolint: errcheck
+		}
+		// Wait for the attach to end, so that nothing is left behind the session.
+		return <-errCh
+	}
+}
+
+// errDetached is returned by writes to the output of a detached session.
+var errDetached = errors.New("attach session is detached")
+
+// detachableWriter forwards writes to the client until it is closed on detach. The
+// client streams are owned by the stream server, so they are not closed.
+type detachableWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+// Write writes to the client, or returns errDetached after detach.
+func (d *detachableWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, errDetached
+	}
+	return d.w.Write(p)
+}
+
+// Close stops forwarding to the client.
+func (d *detachableWriter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	return nil
+}
+
+// maxReplayBytes is the max bytes read from the end of the container log for replay.
+const maxReplayBytes = 1024 * 1024
+
+// replayLogTail writes the content of the last lines of the CRI container log to
+// stdout and stderr according to the stream of each line. All content is written to
+// stdout for tty, and lines of streams not attached are skipped.
+func replayLogTail(path string, lines int, stdout, stderr io.Writer, tty bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size() - maxReplayBytes
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxReplayBytes))
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		// Drop the first line which may be partial.
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	logs := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(logs) > lines {
+		logs = logs[len(logs)-lines:]
+	}
+	for _, l := range logs {
+		// A CRI log line is in "timestamp stream content" format.
+		fields := strings.SplitN(l, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		w := stdout
+		if fields[1] == string(cio.Stderr) && !tty {
+			w = stderr
+		}
+		if w == nil {
+			continue
+		}
+		if _, err := io.WriteString(w, fields[2]+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDetachKeys parses the detach key sequence in docker format, e.g. "ctrl-p,ctrl-q".
+// Each key is either a single character or "ctrl-<value>", where <value> is one of
+// a-z, @, [, \, ], ^ or _. Empty keys disable detaching.
+func parseDetachKeys(keys string) ([]byte, error) {
+	if keys == "" {
+		return nil, nil
+	}
+	var codes []byte
+	for _, key := range strings.Split(keys, ",") {
+		if len(key) == 1 {
+			codes = append(codes, key[0])
+			continue
+		}
+		if !strings.HasPrefix(key, "ctrl-") || len(key) != len("ctrl-")+1 {
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+		switch k := key[len("ctrl-")]; {
+		case k >= 'a' && k <= 'z':
+			codes = append(codes, k-'a'+1)
+		case k >= '@' && k <= '_':
+			codes = append(codes, k-'@')
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return codes, nil
+}
+
+// detachReader wraps the stdin reader, and returns io.EOF once the detach key sequence
+// is read. The detach keys are consumed and not forwarded.
+type detachReader struct {
+	r        io.Reader
+	keys     []byte
+	fallback []int
+	matched  int
+	pending  []byte
+	err      error
+	detached chan struct{}
+}
+
+func newDetachReader(r io.Reader, keys []byte) *detachReader {
+	return &detachReader{
+		r:        r,
+		keys:     keys,
+		fallback: keysFallback(keys),
+		detached: make(chan struct{}),
+	}
+}
+
+// Read reads from the underlying reader with the detach keys filtered out.
+func (d *detachReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		buf := make([]byte, len(p))
+		n, err := d.r.Read(buf)
+		if d.scan(buf[:n]) {
+			close(d.detached)
+			d.err = io.EOF
+		} else if err != nil {
+			// Forward the partially matched keys.
+			d.pending = append(d.pending, d.keys[:d.matched]...)
+			d.matched = 0
+			d.err = err
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+// scan appends data to be forwarded to pending, and holds back the partially matched
+// keys. It returns true when the whole key sequence is matched, and the data after
+// the key sequence is dropped. On a mismatch, the match falls back to the longest
+// held back suffix which is still a prefix of the keys, e.g. "p p p q" matches the
+// keys "p p q".
+func (d *detachReader) scan(data []byte) bool {
+	for _, b := range data {
+		for d.matched > 0 && b != d.keys[d.matched] {
+			next := d.fallback[d.matched-1]
+			d.pending = append(d.pending, d.keys[:d.matched-next]...)
+			d.matched = next
+		}
+		if b != d.keys[d.matched] {
+			d.pending = append(d.pending, b)
+			continue
+		}
+		d.matched++
+		if d.matched == len(d.keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// keysFallback returns, for each prefix keys[:i+1], the length of its longest proper
+// suffix which is also a prefix of keys, i.e. the KMP failure function.
+func keysFallback(keys []byte) []int {
+	fallback := make([]int, len(keys))
+	for i, k := 1, 0; i < len(keys); i++ {
+		for k > 0 && keys[i] != keys[k] {
+			k = fallback[k-1]
+		}
+		if keys[i] == keys[k] {
+			k++
+		}
+		fallback[i] = k
+	}
+	return fallback
+}
+
+// isDetached returns whether the detach key sequence has been read.
+func (d *detachReader) isDetached() bool {
+	select {
+	case <-d.detached:
+		return true
+	default:
+		return false
+	}
+}
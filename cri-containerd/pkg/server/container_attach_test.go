@@ -0,0 +1,208 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cio "github.com/kubernetes-incubator/cri-containerd/pkg/server/io"
+)
+
+func TestParseDetachKeys(t *testing.T) {
+	for desc, test := range map[string]struct {
+		keys      string
+		expected  []byte
+		expectErr bool
+	}{
+		"should disable detaching with empty keys": {},
+		"should parse docker default detach keys": {
+			keys:     "ctrl-p,ctrl-q",
+			expected: []byte{16, 17},
+		},
+		"should parse single characters and special ctrl keys": {
+			keys:     "a,ctrl-@,ctrl-[,ctrl-_",
+			expected: []byte{'a', 0, 27, 31},
+		},
+		"should return error for invalid ctrl key": {
+			keys:      "ctrl-1",
+			expectErr: true,
+		},
+		"should return error for invalid key": {
+			keys:      "ctrl-p,abc",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		keys, err := parseDetachKeys(test.keys)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, keys)
+	}
+}
+
+func TestDetachReader(t *testing.T) {
+	defaultKeys := []byte{16, 17}
+	for desc, test := range map[string]struct {
+		keys     []byte
+		input    []byte
+		expected []byte
+		detached bool
+	}{
+		"should forward input without detach keys": {
+			input:    []byte("hello world"),
+			expected: []byte("hello world"),
+		},
+		"should consume detach keys and stop reading": {
+			input:    append(append([]byte("hello"), defaultKeys...), []byte("world")...),
+			expected: []byte("hello"),
+			detached: true,
+		},
+		"should forward partially matched detach keys": {
+			input:    []byte{'a', 16, 'b', 16, 16, 17},
+			expected: []byte{'a', 16, 'b', 16},
+			detached: true,
+		},
+		"should match detach keys with overlapping prefix": {
+			keys:     []byte{16, 16, 17},
+			input:    []byte{16, 16, 16, 17},
+			expected: []byte{16},
+			detached: true,
+		},
+		"should forward bytes falling out of overlapping match": {
+			keys:     []byte{16, 16, 17},
+			input:    []byte{16, 16, 'a', 16, 16, 16},
+			expected: []byte{16, 16, 'a', 16, 16, 16},
+		},
+		"should forward partially matched detach keys at the end": {
+			input:    []byte{'a', 16},
+			expected: []byte{'a', 16},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		keys := defaultKeys
+		if test.keys != nil {
+			keys = test.keys
+		}
+		r := newDetachReader(bytes.NewReader(test.input), keys)
+		output, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, output)
+		assert.Equal(t, test.detached, r.isDetached())
+	}
+}
+
+// nopWriteCloser is a client stream in the attach tests.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestAttachIODetach(t *testing.T) {
+	keys := []byte{16, 17}
+	stdin, stdinW := io.Pipe()
+	detach := newDetachReader(stdin, keys)
+	attachDone := make(chan struct{})
+	var stdout io.Writer
+	// fakeAttach mimics the container io of a quiet container, which forwards stdin,
+	// and removes the output streams and returns once stdin ends.
+	fakeAttach := func(opts cio.AttachOptions) error {
+		defer close(attachDone)
+		stdout = opts.Stdout
+		_, err := io.Copy(ioutil.Discard, opts.Stdin)
+		return err
+	}
+	opts := cio.AttachOptions{
+		Stdin:  detach,
+		Stdout: nopWriteCloser{ioutil.Discard},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- attachIO(fakeAttach, opts, detach)
+	}()
+
+	_, err := stdinW.Write(append([]byte("input"), keys...))
+	require.NoError(t, err)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("attach should return after detach")
+	}
+	select {
+	case <-attachDone:
+	default:
+		t.Fatal("container io attach should have ended after detach")
+	}
+	_, err = stdout.Write([]byte("output"))
+	assert.Equal(t, errDetached, err, "output should not be forwarded after detach")
+}
+
+func TestReplayLogTail(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-replay-log")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join([]string{
+		"2017-10-06T00:17:09.669794202Z stdout line 1",
+		"2017-10-06T00:17:09.669794203Z stderr line 2",
+		"2017-10-06T00:17:09.669794204Z stdout line 3",
+		"2017-10-06T00:17:09.669794205Z stderr line 4",
+	}, "\n") + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for desc, test := range map[string]struct {
+		lines          int
+		tty            bool
+		expectedStdout string
+		expectedStderr string
+	}{
+		"should replay the last lines to their streams": {
+			lines:          3,
+			expectedStdout: "line 3\n",
+			expectedStderr: "line 2\nline 4\n",
+		},
+		"should replay all lines when the log is shorter": {
+			lines:          10,
+			expectedStdout: "line 1\nline 3\n",
+			expectedStderr: "line 2\nline 4\n",
+		},
+		"should replay all streams to stdout for tty": {
+			lines:          2,
+			tty:            true,
+			expectedStdout: "line 3\nline 4\n",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		require.NoError(t, replayLogTail(f.Name(), test.lines, stdout, stderr, test.tty))
+		assert.Equal(t, test.expectedStdout, stdout.String())
+		assert.Equal(t, test.expectedStderr, stderr.String())
+	}
+}
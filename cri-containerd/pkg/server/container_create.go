@@ -17,11 +17,19 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/containers"
@@ -38,6 +46,7 @@ import (
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
 	"github.com/opencontainers/runtime-tools/validate"
+	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/syndtr/gocapability/capability"
 	"golang.org/x/net/context"
@@ -61,10 +70,293 @@ const (
 	appArmorDefaultProfileName = "cri-containerd.apparmor.d"
 	// unconfinedProfile is a string indicating one should run a pod/containerd without a security profile
 	unconfinedProfile = "unconfined"
+	// apparmorPolicyFail fails container creation if the default apparmor
+	// profile can't be applied.
+	apparmorPolicyFail = "fail"
+	// apparmorPolicyUnconfined runs the container unconfined if the default
+	// apparmor profile can't be applied.
+	apparmorPolicyUnconfined = "unconfined"
 	// seccompDefaultProfile is the default seccomp profile.
 	seccompDefaultProfile = dockerDefault
+	// seccompActNotify is the seccomp action forwarding syscalls to a user space listener.
+	seccompActNotify = runtimespec.LinuxSeccompAction("SCMP_ACT_NOTIFY")
+	// inlineProfilePrefix is the prefix of a seccomp profile passed by content, which
+	// is either raw JSON or base64 encoded JSON, e.g. inline/eyJkZWZhdWx0QWN0aW9uIjoi...
+	inlineProfilePrefix = "inline/"
+	// maxInlineSeccompProfileSize is the max size of a decoded inline seccomp profile.
+	maxInlineSeccompProfileSize = 64 * 1024
 )
 
+// MountHostLocaltime indicates whether host /etc/localtime should be mounted into
+// containers readonly, unless the container mounts it itself or TZ is set in the
+// container or image environment. Clusters standardizing on UTC in container could
+// disable it.
+var MountHostLocaltime = true
+
+const (
+	// selinuxRelabelShared relabels mount content shared among containers, same with docker "z".
+	selinuxRelabelShared = "z"
+	// selinuxRelabelPrivate relabels mount content private to the container, same with docker "Z".
+	selinuxRelabelPrivate = "Z"
+)
+
+const (
+	// mountTypeDirectory indicates the host path of a mount is a directory.
+	mountTypeDirectory = "directory"
+	// mountTypeFile indicates the host path of a mount is a file.
+	mountTypeFile = "file"
+)
+
+// mountOptions contains cri-containerd specific options of a mount.
+type mountOptions struct {
+	// SelinuxRelabel is the selinux relabel mode of the mount, either
+	// selinuxRelabelShared or selinuxRelabelPrivate.
+	SelinuxRelabel string `json:"selinuxRelabel,omitempty"`
+	// Type is the type of the mount host path, either mountTypeDirectory or
+	// mountTypeFile. It decides what to create when the host path doesn't
+	// exist, and defaults to mountTypeDirectory.
+	Type string `json:"type,omitempty"`
+	// Options are extra mount options appended to the bind mount, which must be
+	// in allowedBindMountOptions.
+	Options []string `json:"options,omitempty"`
+}
+
+const (
+	// cgroupMountReadOnly mounts the cgroup filesystem readonly, which is the default.
+	cgroupMountReadOnly = "ro"
+	// cgroupMountReadWrite mounts the cgroup filesystem writable.
+	cgroupMountReadWrite = "rw"
+	// cgroupMountNone doesn't mount the cgroup filesystem.
+	cgroupMountNone = "none"
+)
+
+// cgroupMountModes are the supported cgroup mount modes.
+var cgroupMountModes = []string{cgroupMountReadOnly, cgroupMountReadWrite, cgroupMountNone}
+
+// getCgroupMountMode returns the cgroup mount mode of the container. The
+// annotation overrides the node default, which defaults to cgroupMountReadOnly.
+func getCgroupMountMode(defaultMode string, annotations map[string]string) (string, error) {
+	mode := cgroupMountReadOnly
+	if defaultMode != "" {
+		mode = defaultMode
+	}
+	if m, ok := annotations[cgroupMountAnnotation]; ok {
+		mode = m
+	}
+	if !util.InStringSlice(cgroupMountModes, mode) {
+		return "", fmt.Errorf("invalid cgroup mount mode %q", mode)
+	}
+	return mode, nil
+}
+
+// allowedBindMountOptions are the extra mount options allowed on bind mounts.
+var allowedBindMountOptions = []string{
+	"nosuid", "nodev", "noexec", "noatime", "nodiratime", "relatime", "strictatime",
+}
+
+// SpecMutator mutates the runtime spec of a container before the container is created.
+type SpecMutator func(*runtimespec.Spec) error
+
+// specMutators are the registered spec mutators, applied in registration order.
+var specMutators []SpecMutator
+
+// RegisterSpecMutator registers a spec mutator, which is applied to the runtime spec
+// of every container after it is generated. It should be called during initialization,
+// e.g. in init function of a site specific package.
+func RegisterSpecMutator(m SpecMutator) {
+	specMutators = append(specMutators, m)
+}
+
+// applySpecMutators applies all registered spec mutators to the spec, and returns
+// the first error encountered.
+func applySpecMutators(spec *runtimespec.Spec) error {
+	for i, m := range specMutators {
+		if err := m(spec); err != nil {
+			return fmt.Errorf("spec mutator %d failed: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// getImageUser returns the image user to run the container process as, including the
+// group in "user:group" format. It is empty if the container config overrides the
+// user, which is the same with docker.
+func getImageUser(securityContext *runtime.LinuxContainerSecurityContext, imageConfig *imagespec.ImageConfig) string {
+	if securityContext.GetRunAsUser() != nil || securityContext.GetRunAsUsername() != "" {
+		return ""
+	}
+	return imageConfig.User
+}
+
+// ensureSandboxRunning returns an error if the sandbox task is not running. This is
+// only a best effort check, sandbox may still exit after this. Without it, the
+// container would be created against dead namespaces and fail obscurely at start.
+func ensureSandboxRunning(ctx context.Context, sandboxID string, task containerd.Task) error {
+	taskStatus, err := task.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get task status for sandbox %q: %v", sandboxID, err)
+	}
+	if taskStatus.Status != containerd.Running {
+		return fmt.Errorf("sandbox %q is not running", sandboxID)
+	}
+	return nil
+}
+
+// DeviceProvider provides host resources with complex device setup, e.g. GPUs, to
+// containers.
+type DeviceProvider interface {
+	// Allocate returns the devices, mounts and environment variables to inject
+	// into the container for it to use count resources.
+	Allocate(containerID string, count int) (*DeviceAllocation, error)
+	// Release releases the resources allocated to the container. It is called
+	// when the container creation fails or the container is removed, and must
+	// be a no-op if nothing is allocated to the container.
+	Release(containerID string) error
+}
+
+// DeviceAllocation is what a DeviceProvider injects into a container.
+type DeviceAllocation struct {
+	// Devices are the host devices to add into the container.
+	Devices []*runtime.Device
+	// Mounts are the host paths to mount into the container, e.g. driver libraries.
+	Mounts []*runtime.Mount
+	// Envs are the environment variables in "key=value" format.
+	Envs []string
+}
+
+// deviceProviders are the registered device providers, keyed by resource name.
+var deviceProviders = make(map[string]DeviceProvider)
+
+// RegisterDeviceProvider registers a device provider for the resource name, e.g.
+// "nvidia.com/gpu". Containers request the resource with the annotation
+// deviceResourceAnnotationPrefix + resource. It should be called during
+// initialization, e.g. in init function of a site specific package.
+func RegisterDeviceProvider(resource string, p DeviceProvider) {
+	deviceProviders[resource] = p
+}
+
+// allocateDevices allocates the resources requested in the container annotations
+// from the registered device providers, in the order of resource names.
+func allocateDevices(id string, annotations map[string]string) (*DeviceAllocation, error) {
+	var resources []string
+	for k := range annotations {
+		if strings.HasPrefix(k, deviceResourceAnnotationPrefix) {
+			resources = append(resources, strings.TrimPrefix(k, deviceResourceAnnotationPrefix))
+		}
+	}
+	sort.Strings(resources)
+	allocation := &DeviceAllocation{}
+	for _, resource := range resources {
+		value := annotations[deviceResourceAnnotationPrefix+resource]
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count %q of resource %q", value, resource)
+		}
+		if count == 0 {
+			continue
+		}
+		p, ok := deviceProviders[resource]
+		if !ok {
+			return nil, fmt.Errorf("no device provider for resource %q", resource)
+		}
+		a, err := p.Allocate(id, count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate %d of resource %q: %v", count, resource, err)
+		}
+		allocation.Devices = append(allocation.Devices, a.Devices...)
+		allocation.Mounts = append(allocation.Mounts, a.Mounts...)
+		allocation.Envs = append(allocation.Envs, a.Envs...)
+	}
+	return allocation, nil
+}
+
+// releaseDevices releases the resources requested in the container annotations from
+// the registered device providers. Errors are logged, so that all providers are
+// released.
+func releaseDevices(id string, annotations map[string]string) {
+	for k := range annotations {
+		if !strings.HasPrefix(k, deviceResourceAnnotationPrefix) {
+			continue
+		}
+		resource := strings.TrimPrefix(k, deviceResourceAnnotationPrefix)
+		p, ok := deviceProviders[resource]
+		if !ok {
+			continue
+		}
+		if err := p.Release(id); err != nil {
+			glog.Errorf("Failed to release resource %q of container %q: %v", resource, id, err)
+		}
+	}
+}
+
+// CDIResolver resolves Container Device Interface (CDI) devices to the edits to
+// apply to the container.
+type CDIResolver interface {
+	// Resolve returns the edits for the fully qualified CDI device names, e.g.
+	// "vendor.com/gpu=0".
+	Resolve(devices []string) (*CDIEdits, error)
+}
+
+// CDIEdits are the container edits of CDI devices.
+type CDIEdits struct {
+	DeviceAllocation
+	// Hooks are the OCI hooks to add to the container, e.g. to update the ldcache.
+	Hooks *runtimespec.Hooks
+}
+
+// cdiResolver is the registered CDI resolver.
+var cdiResolver CDIResolver
+
+// RegisterCDIResolver registers the CDI resolver. It should be called during
+// initialization, e.g. in init function of a site specific package.
+func RegisterCDIResolver(r CDIResolver) {
+	cdiResolver = r
+}
+
+// isCDIDeviceName returns whether the name is a fully qualified CDI device name in
+// "vendor/class=name" format.
+func isCDIDeviceName(name string) bool {
+	parts := strings.SplitN(name, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return false
+	}
+	return !strings.HasPrefix(parts[0], "/") && strings.Contains(parts[0], "/")
+}
+
+// resolveCDIDevices resolves the CDI devices requested by the annotation, or by the
+// CRI devices with a CDI device name as host path. It returns the other CRI devices,
+// and the edits which are nil if no CDI device is requested.
+func resolveCDIDevices(config *runtime.ContainerConfig) ([]*runtime.Device, *CDIEdits, error) {
+	var names []string
+	if v := config.GetAnnotations()[cdiDevicesAnnotation]; v != "" {
+		names = strings.Split(v, ",")
+	}
+	var devs []*runtime.Device
+	for _, d := range config.GetDevices() {
+		if isCDIDeviceName(d.GetHostPath()) {
+			names = append(names, d.GetHostPath())
+			continue
+		}
+		devs = append(devs, d)
+	}
+	if len(names) == 0 {
+		return devs, nil, nil
+	}
+	for _, n := range names {
+		if !isCDIDeviceName(n) {
+			return nil, nil, fmt.Errorf("invalid CDI device name %q", n)
+		}
+	}
+	if cdiResolver == nil {
+		return nil, nil, fmt.Errorf("no CDI resolver for devices %v", names)
+	}
+	edits, err := cdiResolver.Resolve(names)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve CDI devices %v: %v", names, err)
+	}
+	return devs, edits, nil
+}
+
 func init() {
 	typeurl.Register(&containerstore.Metadata{},
 		"github.com/kubernetes-incubator/cri-containerd/pkg/store/container", "Metadata")
@@ -86,6 +378,9 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	if err != nil {
 		return nil, fmt.Errorf("failed to get sandbox container task: %v", err)
 	}
+	if err := ensureSandboxRunning(ctx, sandboxID, s); err != nil {
+		return nil, err
+	}
 	// 获取sandbox所在容器的pid
 	sandboxPid := s.Pid()
 
@@ -94,6 +389,9 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	// the same container.
 	// 创建container ID和container name
 	id := util.GenerateID()
+	if err := validateContainerName(config.GetMetadata(), sandboxConfig.GetMetadata()); err != nil {
+		return nil, fmt.Errorf("invalid container name: %v", err)
+	}
 	name := makeContainerName(config.GetMetadata(), sandboxConfig.GetMetadata())
 	glog.V(4).Infof("Generated id %q for container %q", id, name)
 	if err = c.containerNameIndex.Reserve(name, id); err != nil {
@@ -106,6 +404,11 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		}
 	}()
 
+	// Validate the stop timeout, which is persisted with the container config.
+	if _, err := getStopTimeout(config); err != nil {
+		return nil, err
+	}
+
 	// Create initial internal container metadata.
 	// 创建容器的元数据
 	meta := containerstore.Metadata{
@@ -115,6 +418,14 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		Config:    config,
 	}
 
+	// Limit the concurrent snapshot and mount preparation, which could thrash slow
+	// storage under a burst of container creation.
+	release, err := c.acquireCreateSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	// Prepare container image snapshot. For container, the image should have
 	// been pulled before creating the container, so do not ensure the image.
 	// 准备容器镜像的snapshot，对于容器，镜像需要在容器创建之前就已经被拉取
@@ -130,6 +441,9 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	// Create container root directory.
 	// 创建container的root目录，/var/lib/cri-containerd/containers/id
 	containerRootDir := getContainerRootDir(c.config.RootDir, id)
+	if err := c.ensureNoStaleContainerRootDir(id, containerRootDir); err != nil {
+		return nil, err
+	}
 	if err = c.os.MkdirAll(containerRootDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create container root directory %q: %v",
 			containerRootDir, err)
@@ -144,20 +458,60 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		}
 	}()
 
+	for _, w := range configWarnings(config, image.Config) {
+		glog.Warningf("Container %q in sandbox %q: %s", name, sandboxID, w)
+	}
+
 	// Create container volumes mounts.
 	// 创建容器的volume mounts，返回的是runtime.Mount
 	// TODO(random-liu): Add cri-containerd integration test for image volume.
-	volumeMounts := c.generateVolumeMounts(containerRootDir, config.GetMounts(), image.Config)
+	var persistentVolumeDir string
+	if v, ok := config.GetAnnotations()[persistentImageVolumesAnnotation]; ok {
+		persistent, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid persistent image volumes annotation %q: %v", v, err)
+		}
+		if persistent {
+			persistentVolumeDir = filepath.Join(getSandboxRootDir(c.config.RootDir, sandboxID),
+				"volumes", config.GetMetadata().GetName())
+		}
+	}
+	volumeMounts := c.generateVolumeMounts(containerRootDir, persistentVolumeDir, config.GetMounts(), image.Config)
 
 	// Generate container runtime spec.
-	mounts := c.generateContainerMounts(getSandboxRootDir(c.config.RootDir, sandboxID), config)
+	mounts := c.generateContainerMounts(getSandboxRootDir(c.config.RootDir, sandboxID), config, image.Config)
 
+	// Release the devices allocated in the spec generation if the function returns
+	// with an error.
+	defer func() {
+		if retErr != nil {
+			releaseDevices(id, config.GetAnnotations())
+		}
+	}()
 	// 创建container spec
-	spec, err := c.generateContainerSpec(id, sandboxPid, config, sandboxConfig, image.Config, append(mounts, volumeMounts...))
+	spec, err := c.generateContainerSpec(id, sandboxPid, config, sandboxConfig, image.Config, mounts, volumeMounts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate container %q spec: %v", id, err)
 	}
-	glog.V(4).Infof("Container %q spec: %#+v", id, spew.NewFormatter(spec))
+	if c.config.InjectPodEnvs {
+		// The sandbox IP is only known at create time, so it is not part of the
+		// generated spec.
+		ip, err := c.getIP(sandbox)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sandbox %q ip: %v", sandboxID, err)
+		}
+		addOCIPodEnvs(spec, ip)
+	}
+	if err := applySpecMutators(spec); err != nil {
+		return nil, fmt.Errorf("failed to mutate container %q spec: %v", id, err)
+	}
+	if c.config.ValidateSpec {
+		if err := validateSpec(spec); err != nil {
+			glog.Errorf("Container %q spec is invalid: %v", id, err)
+			return nil, fmt.Errorf("invalid container %q spec: %v", id, err)
+		}
+	}
+	glog.V(4).Infof("Container %q spec: %#+v", id, spew.NewFormatter(redactSpec(spec, c.config.MaskedEnvs)))
 
 	// Set snapshotter before any other options.
 	// 首先设置snapshotter
@@ -175,7 +529,22 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		containerd.WithNewSnapshot(id, image.Image),
 	}
 
-	if len(volumeMounts) > 0 {
+	var overlayVolumes bool
+	var overlayVolumesOpts containerd.SpecOpts
+	if v, ok := config.GetAnnotations()[overlayImageVolumesAnnotation]; ok {
+		if overlayVolumes, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid overlay image volumes annotation %q: %v", v, err)
+		}
+	}
+	if len(volumeMounts) > 0 && overlayVolumes {
+		// The image content is the lower layer of the overlay, so it is not
+		// copied into the volumes.
+		overlayMap := make(map[string]string)
+		for _, v := range volumeMounts {
+			overlayMap[v.ContainerPath] = v.HostPath
+		}
+		overlayVolumesOpts = customopts.WithOverlayVolumes(overlayMap)
+	} else if len(volumeMounts) > 0 {
 		mountMap := make(map[string]string)
 		for _, v := range volumeMounts {
 			mountMap[v.HostPath] = v.ContainerPath
@@ -190,8 +559,9 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	}
 
 	// 创建容器io，io是独立创建的
+	fifoDir := getContainerFIFODir(c.config.RootDir, c.config.FIFODir, id)
 	containerIO, err := cio.NewContainerIO(id,
-		cio.WithNewFIFOs(containerRootDir, config.GetTty(), config.GetStdin()))
+		cio.WithNewFIFOs(fifoDir, config.GetTty(), config.GetStdin()))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create container io: %v", err)
 	}
@@ -200,11 +570,20 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 			if err := containerIO.Close(); err != nil {
 				glog.Errorf("Failed to close container io %q : %v", id, err)
 			}
+			// The container root directory is removed above.
+			if fifoDir != containerRootDir {
+				if err := c.os.RemoveAll(fifoDir); err != nil {
+					glog.Errorf("Failed to remove container fifo directory %q: %v", fifoDir, err)
+				}
+			}
 		}
 	}()
 
 	// 创建SpecOpts
 	var specOpts []containerd.SpecOpts
+	if overlayVolumesOpts != nil {
+		specOpts = append(specOpts, overlayVolumesOpts)
+	}
 	securityContext := config.GetLinux().GetSecurityContext()
 	// Set container username. This could only be done by containerd, because it needs
 	// access to the container rootfs. Pass user name to containerd, and let it overwrite
@@ -212,14 +591,56 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 	if uid := securityContext.GetRunAsUser(); uid != nil {
 		specOpts = append(specOpts, containerd.WithUserID(uint32(uid.GetValue())))
 	}
+	// The options reading the container rootfs are applied together, so that the
+	// rootfs is mounted at most once.
+	var rootfsOpts []customopts.RootfsOpt
 	if username := securityContext.GetRunAsUsername(); username != "" {
-		specOpts = append(specOpts, containerd.WithUsername(username))
+		// The username could be in "user:group" format, in which case the
+		// primary group of the container process is also set.
+		rootfsOpts = append(rootfsOpts, customopts.WithUser(username))
+	}
+	if imageUser := getImageUser(securityContext, image.Config); imageUser != "" {
+		rootfsOpts = append(rootfsOpts, customopts.WithUser(imageUser))
+	}
+
+	if names := config.GetAnnotations()[supplementalGroupNamesAnnotation]; names != "" {
+		rootfsOpts = append(rootfsOpts, customopts.WithAdditionalGroups(strings.Split(names, ",")))
+	}
+
+	if c.config.DefaultWorkingDir != "" && c.config.CheckDefaultWorkingDir &&
+		config.GetWorkingDir() == "" && image.Config.WorkingDir == "" {
+		rootfsOpts = append(rootfsOpts, customopts.WithWorkingDirCheck())
+	}
+
+	if path, ok := config.GetAnnotations()[entrypointFileAnnotation]; ok {
+		if !c.config.EnableEntrypointFile {
+			return nil, fmt.Errorf("entrypoint file %q is not enabled", path)
+		}
+		// The entrypoint file replaces the process args after the spec is generated,
+		// which would drop the init.
+		if useInit, _ := strconv.ParseBool(config.GetAnnotations()[initAnnotation]); useInit {
+			return nil, fmt.Errorf("entrypoint file %q is not supported with init", path)
+		}
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("entrypoint file %q is not an absolute path", path)
+		}
+		args := config.GetArgs()
+		if len(config.GetCommand()) == 0 && len(args) == 0 {
+			args = image.Config.Cmd
+		}
+		rootfsOpts = append(rootfsOpts, customopts.WithEntrypointFromFile(path, args))
 	}
+	if len(rootfsOpts) > 0 {
+		specOpts = append(specOpts, customopts.WithRootfs(rootfsOpts...))
+	}
+	// Check the user set above against the id mappings of the user namespace.
+	specOpts = append(specOpts, customopts.WithUserMappingCheck())
 
 	apparmorSpecOpts, err := generateApparmorSpecOpts(
 		securityContext.GetApparmorProfile(),
 		securityContext.GetPrivileged(),
-		c.apparmorEnabled)
+		c.apparmorEnabled,
+		c.config.ApparmorDefaultProfilePolicy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate apparmor spec opts: %v", err)
 	}
@@ -235,7 +656,17 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 		return nil, fmt.Errorf("failed to generate seccomp spec opts: %v", err)
 	}
 	if seccompSpecOpts != nil {
+		if err := checkSeccompProfileSupported(securityContext.GetSeccompProfilePath()); err != nil {
+			return nil, fmt.Errorf("unsupported seccomp profile: %v", err)
+		}
 		specOpts = append(specOpts, seccompSpecOpts)
+		if v := config.GetAnnotations()[seccompAllowedSyscallsAnnotation]; v != "" {
+			allowOpts, err := withAllowedSyscalls(strings.Split(v, ","))
+			if err != nil {
+				return nil, fmt.Errorf("invalid seccomp allowed syscalls %q: %v", v, err)
+			}
+			specOpts = append(specOpts, allowOpts)
+		}
 	}
 	// containerKindContainer是常量"container"，代表的是创建application container
 	containerLabels := buildLabels(config.Labels, containerKindContainer)
@@ -295,10 +726,15 @@ func (c *criContainerdService) CreateContainer(ctx context.Context, r *runtime.C
 }
 
 func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint32, config *runtime.ContainerConfig,
-	sandboxConfig *runtime.PodSandboxConfig, imageConfig *imagespec.ImageConfig, extraMounts []*runtime.Mount) (*runtimespec.Spec, error) {
+	sandboxConfig *runtime.PodSandboxConfig, imageConfig *imagespec.ImageConfig, extraMounts, volumeMounts []*runtime.Mount) (*runtimespec.Spec, error) {
+	// Validate the CRI mounts early, so that malformed mounts don't fail confusingly
+	// in the middle of the spec generation or in the runtime.
+	if err := validateMounts(config.GetMounts()); err != nil {
+		return nil, err
+	}
 	// Creates a spec Generator with the default spec.
 	// 创建一个有默认spec的spec generator
-	spec, err := defaultRuntimeSpec(id)
+	spec, err := defaultRuntimeSpec(c.namespace, id, c.config.KeepRunMount)
 	if err != nil {
 		return nil, err
 	}
@@ -311,26 +747,61 @@ func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint3
 	if err := setOCIProcessArgs(&g, config, imageConfig); err != nil {
 		return nil, err
 	}
+	if v, ok := config.GetAnnotations()[initAnnotation]; ok {
+		useInit, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid init annotation %q: %v", v, err)
+		}
+		if useInit {
+			if c.config.InitPath == "" {
+				return nil, fmt.Errorf("no init configured on the node")
+			}
+			// Check the init binary, or a directory would be created in its
+			// place when it is mounted.
+			if _, err := c.os.Stat(c.config.InitPath); err != nil {
+				return nil, fmt.Errorf("failed to stat init %q: %v", c.config.InitPath, err)
+			}
+			setOCIInit(&g)
+			// Copy extra mounts to avoid modifying the caller's slice.
+			extraMounts = append(append([]*runtime.Mount{}, extraMounts...), &runtime.Mount{
+				ContainerPath: containerInitPath,
+				HostPath:      c.config.InitPath,
+				Readonly:      true,
+			})
+		}
+	}
 
 	if config.GetWorkingDir() != "" {
 		g.SetProcessCwd(config.GetWorkingDir())
 	} else if imageConfig.WorkingDir != "" {
 		g.SetProcessCwd(imageConfig.WorkingDir)
+	} else if dir := c.config.DefaultWorkingDir; dir != "" {
+		// The default working directory is validated when the service starts.
+		g.SetProcessCwd(dir)
 	}
 
 	g.SetProcessTerminal(config.GetTty())
-	if config.GetTty() {
-		g.AddProcessEnv("TERM", "xterm")
+	if err := setOCIProcessEnv(&g, config, imageConfig); err != nil {
+		return nil, err
 	}
 
-	// Apply envs from image config first, so that envs from container config
-	// can override them.
-	// 首先应用image config，从而能让container config中的env覆盖它们
-	if err := addImageEnvs(&g, imageConfig.Env); err != nil {
+	allocation, err := allocateDevices(id, config.GetAnnotations())
+	if err != nil {
 		return nil, err
 	}
-	for _, e := range config.GetEnvs() {
-		g.AddProcessEnv(e.GetKey(), e.GetValue())
+	criDevices, cdiEdits, err := resolveCDIDevices(config)
+	if err != nil {
+		return nil, err
+	}
+	if cdiEdits != nil {
+		allocation.Devices = append(allocation.Devices, cdiEdits.Devices...)
+		allocation.Mounts = append(allocation.Mounts, cdiEdits.Mounts...)
+		allocation.Envs = append(allocation.Envs, cdiEdits.Envs...)
+	}
+	// Envs from device providers and CDI devices are added after the container envs, because
+	// they describe the allocated devices.
+	if err := addImageEnvs(&g, allocation.Envs); err != nil {
+		return nil, fmt.Errorf("invalid device provider envs: %v", err)
 	}
 
 	securityContext := config.GetLinux().GetSecurityContext()
@@ -339,66 +810,306 @@ func (c *criContainerdService) generateContainerSpec(id string, sandboxPid uint3
 	if err != nil {
 		return nil, fmt.Errorf("failed to init selinux options %+v: %v", securityContext.GetSelinuxOptions(), err)
 	}
+	if securityContext.GetPrivileged() && !c.config.KeepPrivilegedSelinuxLabels {
+		// Do not set selinux labels for privileged container by default, so that
+		// it runs as spc_t (super privileged container) with container-selinux
+		// policy, which is the same with docker.
+		processLabel, mountLabel = "", ""
+	}
 
-	// Add extra mounts first so that CRI specified mounts can override.
-	mounts := append(extraMounts, config.GetMounts()...)
-	if err := c.addOCIBindMounts(&g, mounts, mountLabel); err != nil {
+	mountOpts, err := getMountOptions(config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	// Set the explicit rootfs propagation before adding mounts, mounts could only
+	// make it more permissive afterwards.
+	if propagation, ok := config.GetAnnotations()[rootfsPropagationAnnotation]; ok {
+		if err := setOCIRootfsPropagation(&g, propagation); err != nil {
+			return nil, err
+		}
+	}
+	cgroupMount, err := getCgroupMountMode(c.config.CgroupMount, config.GetAnnotations())
+	if err != nil {
+		return nil, err
+	}
+	// Add extra mounts, image volumes and device provider mounts first so that CRI
+	// specified mounts can override.
+	warnings, err := mountConflictWarnings([]mountSource{
+		{name: "generated mounts", mounts: extraMounts},
+		{name: "image volumes", mounts: volumeMounts},
+		{name: "device provider", mounts: allocation.Mounts},
+		{name: "container config", mounts: config.GetMounts()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		glog.Warningf("Container %q: %s", id, w)
+	}
+	mounts := append(append(append(extraMounts, volumeMounts...), allocation.Mounts...), config.GetMounts()...)
+	if err := c.addOCIBindMounts(&g, mounts, mountLabel, mountOpts, cgroupMount); err != nil {
 		return nil, fmt.Errorf("failed to set OCI bind mounts %+v: %v", mounts, err)
 	}
 
 	if securityContext.GetPrivileged() {
-		if !securityContext.GetPrivileged() {
+		if !sandboxConfig.GetLinux().GetSecurityContext().GetPrivileged() {
 			return nil, fmt.Errorf("no privileged container allowed in sandbox")
 		}
-		if err := setOCIPrivileged(&g, config); err != nil {
+		withoutHostDevices := c.config.PrivilegedWithoutHostDevices
+		if v, ok := config.GetAnnotations()[privilegedWithoutHostDevicesAnnotation]; ok {
+			if withoutHostDevices, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid privileged without host devices annotation %q: %v", v, err)
+			}
+		}
+		if err := setOCIPrivileged(&g, config, withoutHostDevices); err != nil {
 			return nil, err
 		}
+		if withoutHostDevices {
+			optionalDevices := strings.Split(config.GetAnnotations()[optionalDevicesAnnotation], ",")
+			devs := append(criDevices, allocation.Devices...)
+			if err := c.addOCIDevices(&g, devs, optionalDevices); err != nil {
+				return nil, fmt.Errorf("failed to set devices mapping %+v: %v", devs, err)
+			}
+		}
 	} else { // not privileged
-		if err := c.addOCIDevices(&g, config.GetDevices()); err != nil {
-			return nil, fmt.Errorf("failed to set devices mapping %+v: %v", config.GetDevices(), err)
+		optionalDevices := strings.Split(config.GetAnnotations()[optionalDevicesAnnotation], ",")
+		devs := append(criDevices, allocation.Devices...)
+		if err := c.addOCIDevices(&g, devs, optionalDevices); err != nil {
+			return nil, fmt.Errorf("failed to set devices mapping %+v: %v", devs, err)
+		}
+
+		if err := setOCIDefaultCapabilities(&g, c.config.DefaultCapabilities); err != nil {
+			return nil, fmt.Errorf("failed to set default capabilities %+v: %v",
+				c.config.DefaultCapabilities, err)
 		}
 
 		if err := setOCICapabilities(&g, securityContext.GetCapabilities()); err != nil {
 			return nil, fmt.Errorf("failed to set capabilities %+v: %v",
 				securityContext.GetCapabilities(), err)
 		}
+
+		if err := addOCIMaskedPaths(&g, c.config.ExtraMaskedPaths); err != nil {
+			return nil, fmt.Errorf("failed to set masked paths %+v: %v", c.config.ExtraMaskedPaths, err)
+		}
 	}
 
 	g.SetProcessSelinuxLabel(processLabel)
 	g.SetLinuxMountLabel(mountLabel)
 
 	// TODO: Figure out whether we should set no new privilege for sandbox container by default
+	// No new privileges is independent of the seccomp profile, including unconfined.
 	g.SetProcessNoNewPrivileges(securityContext.GetNoNewPrivs())
 
-	// TODO(random-liu): [P1] Set selinux options (privileged or not).
-
 	g.SetRootReadonly(securityContext.GetReadonlyRootfs())
+	if securityContext.GetReadonlyRootfs() {
+		addOCIWritablePaths(&g, c.config.ReadonlyRootfsWritablePaths)
+	}
 
-	setOCILinuxResource(&g, config.GetLinux().GetResources())
+	setOCILinuxResource(&g, config.GetLinux().GetResources(), c.cgroupV2)
 
-	if sandboxConfig.GetLinux().GetCgroupParent() != "" {
-		cgroupsPath := getCgroupsPath(sandboxConfig.GetLinux().GetCgroupParent(), id,
-			c.config.SystemdCgroup)
+	if cgroupParent := sandboxConfig.GetLinux().GetCgroupParent(); cgroupParent != "" {
+		if err := validateCgroupParent(cgroupParent, c.config.SystemdCgroup); err != nil {
+			return nil, fmt.Errorf("invalid cgroup parent: %v", err)
+		}
+		if err := c.checkCgroupParent(cgroupParent); err != nil {
+			return nil, fmt.Errorf("unusable cgroup parent: %v", err)
+		}
+		cgroupsPath := getCgroupsPath(cgroupParent, id, c.config.SystemdCgroup)
 		g.SetLinuxCgroupsPath(cgroupsPath)
 	}
+	if cgroupsPath, ok := config.GetAnnotations()[cgroupsPathAnnotation]; ok {
+		if err := validateCgroupsPathOverride(cgroupsPath, c.config.AllowedCgroupsPathPrefixes,
+			c.config.SystemdCgroup); err != nil {
+			return nil, fmt.Errorf("invalid cgroups path override: %v", err)
+		}
+		g.SetLinuxCgroupsPath(filepath.Clean(cgroupsPath))
+	}
 
 	// Set namespaces, share namespace with sandbox container.
 	// 设置namespaces，和其他sandbox共享container
 	setOCINamespaces(&g, securityContext.GetNamespaceOptions(), sandboxPid)
+	// Setting the hostname is opt-in. Skip hostname for host network to avoid renaming
+	// the node.
+	if c.config.SetContainerHostname && !securityContext.GetNamespaceOptions().GetHostNetwork() {
+		hostname := sandboxConfig.GetHostname()
+		if h, ok := config.GetAnnotations()[hostnameAnnotation]; ok && h != hostname {
+			// The hostname is set in the UTS namespace when the container starts. Run
+			// the container in its own UTS namespace, otherwise the hostname of every
+			// container in the pod would be changed.
+			g.AddOrReplaceLinuxNamespace(string(runtimespec.UTSNamespace), "") // nolint: errcheck
+			hostname = h
+		}
+		if len(hostname) > maxHostnameLength {
+			return nil, fmt.Errorf("hostname %q exceeds the max length %d", hostname, maxHostnameLength)
+		}
+		g.SetHostname(hostname)
+	}
+	if c.config.KeepIDUserNamespace && !securityContext.GetPrivileged() {
+		// Privileged container needs the host user namespace to manage the host.
+		if err := setOCIKeepIDUserNamespace(&g, uint32(os.Getuid()), uint32(os.Getgid())); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setOCIHooks(&g, c.config.DefaultHooks, config.GetAnnotations()[hooksAnnotation],
+		c.config.AllowedHookPaths); err != nil {
+		return nil, fmt.Errorf("failed to set hooks: %v", err)
+	}
+	if cdiEdits != nil && cdiEdits.Hooks != nil {
+		spec := g.Spec()
+		if spec.Hooks == nil {
+			spec.Hooks = &runtimespec.Hooks{}
+		}
+		spec.Hooks.Prestart = append(spec.Hooks.Prestart, cdiEdits.Hooks.Prestart...)
+		spec.Hooks.Poststart = append(spec.Hooks.Poststart, cdiEdits.Hooks.Poststart...)
+		spec.Hooks.Poststop = append(spec.Hooks.Poststop, cdiEdits.Hooks.Poststop...)
+	}
 
-	supplementalGroups := securityContext.GetSupplementalGroups()
+	// Sandbox supplemental groups apply to all containers in the sandbox, and are
+	// added before the container specific ones.
+	supplementalGroups := append(append([]int64{}, sandboxConfig.GetLinux().GetSecurityContext().GetSupplementalGroups()...),
+		securityContext.GetSupplementalGroups()...)
+	seen := make(map[int64]bool)
 	for _, group := range supplementalGroups {
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
 		g.AddProcessAdditionalGid(uint32(group))
 	}
 
+	addOCIImageLabelAnnotations(&g, imageConfig.Labels, c.config.ImageLabelAnnotationPrefixes)
+
+	procOptions := c.config.ProcMountOptions
+	if v, ok := config.GetAnnotations()[procMountOptionsAnnotation]; ok {
+		procOptions = strings.Split(v, ",")
+	}
+	if err := setOCIProcMountOptions(&g, procOptions, c.procMountOptionsV2); err != nil {
+		return nil, fmt.Errorf("failed to set /proc mount options: %v", err)
+	}
+
+	if err := setOCIRlimits(&g, c.config.DefaultRlimits, imageConfig.Labels[rlimitsAnnotation],
+		config.GetAnnotations()[rlimitsAnnotation]); err != nil {
+		return nil, fmt.Errorf("failed to set rlimits: %v", err)
+	}
+
+	if ambient, ok := config.GetAnnotations()[ambientCapabilitiesAnnotation]; ok {
+		if err := setOCIAmbientCapabilities(&g, strings.Split(ambient, ",")); err != nil {
+			return nil, fmt.Errorf("failed to set ambient capabilities %q: %v", ambient, err)
+		}
+	}
+
+	sortOCICapabilities(&g)
+
 	return g.Spec(), nil
 }
 
+// configWarnings returns human readable warnings for the container configuration
+// which is partially ignored.
+func configWarnings(config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) []string {
+	var warnings []string
+	for dst := range imageConfig.Volumes {
+		if isInCRIMounts(dst, config.GetMounts()) {
+			warnings = append(warnings, fmt.Sprintf("image volume %q is skipped because it is overridden by a CRI mount", dst))
+		}
+	}
+	for _, m := range config.GetMounts() {
+		switch m.GetPropagation() {
+		case runtime.MountPropagation_PROPAGATION_PRIVATE,
+			runtime.MountPropagation_PROPAGATION_BIDIRECTIONAL,
+			runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
+		default:
+			warnings = append(warnings, fmt.Sprintf("unknown propagation mode %v for mount %q, rprivate is used",
+				m.GetPropagation(), m.GetContainerPath()))
+		}
+	}
+	if v, ok := config.GetAnnotations()[skipDevShmAnnotation]; ok {
+		if _, err := strconv.ParseBool(v); err != nil {
+			warnings = append(warnings, fmt.Sprintf("invalid skip /dev/shm annotation %q, /dev/shm is mounted", v))
+		}
+	}
+	// Keep the output stable since image volumes is a map.
+	sort.Strings(warnings)
+	return warnings
+}
+
+// acquireCreateSlot waits for a free slot of the create limiter, or ctx is done. It
+// returns the function to release the slot.
+func (c *criContainerdService) acquireCreateSlot(ctx context.Context) (func(), error) {
+	if c.createLimiter == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.createLimiter <- struct{}{}:
+		return func() { <-c.createLimiter }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for container create slot: %v", ctx.Err())
+	}
+}
+
+// ensureNoStaleContainerRootDir makes sure the container root directory doesn't exist
+// before it is created, so that stale state can't be reused. A directory left over by
+// a crashed create is removed, while an error is returned if the directory belongs to
+// a known container.
+func (c *criContainerdService) ensureNoStaleContainerRootDir(id, containerRootDir string) error {
+	if _, err := c.os.Stat(containerRootDir); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat container root directory %q: %v", containerRootDir, err)
+	}
+	if _, err := c.containerStore.Get(id); err == nil {
+		return fmt.Errorf("container root directory %q is in use by container %q", containerRootDir, id)
+	}
+	glog.Warningf("Remove stale container root directory %q", containerRootDir)
+	if err := c.os.RemoveAll(containerRootDir); err != nil {
+		return fmt.Errorf("failed to remove stale container root directory %q: %v", containerRootDir, err)
+	}
+	return nil
+}
+
+// mountSource is a named source of container mounts.
+type mountSource struct {
+	name   string
+	mounts []*runtime.Mount
+}
+
+// mountConflictWarnings detects mounts with the same container path. Later sources
+// take precedence over earlier ones, because their mounts are mounted on top, and a
+// warning naming both sources is returned for each overridden mount. The conflict is
+// ambiguous within the container config, so an error is returned in that case.
+func mountConflictWarnings(sources []mountSource) ([]string, error) {
+	var warnings []string
+	owners := make(map[string]string)
+	for _, s := range sources {
+		seen := make(map[string]bool)
+		for _, m := range s.mounts {
+			dst := filepath.Clean(m.GetContainerPath())
+			if seen[dst] {
+				if s.name == "container config" {
+					return nil, fmt.Errorf("duplicate mount container path %q in %s", dst, s.name)
+				}
+				warnings = append(warnings, fmt.Sprintf("mount %q from %s is specified multiple times, the last one applies",
+					dst, s.name))
+			} else if owner, ok := owners[dst]; ok {
+				warnings = append(warnings, fmt.Sprintf("mount %q from %s is overridden by mount from %s",
+					dst, owner, s.name))
+			}
+			seen[dst] = true
+			owners[dst] = s.name
+		}
+	}
+	return warnings, nil
+}
+
 // generateVolumeMounts sets up image volumes for container. Rely on the removal of container
 // root directory to do cleanup. Note that image volume will be skipped, if there is criMounts
-// specified with the same destination.
+// specified with the same destination. If persistentVolumeDir is specified, image volumes
+// are kept there at paths stable for the same destination instead, and are cleaned up
+// with the directory.
 // generateVolumeMounts设置容器的image volumes，依赖容器的根目录的删除来进行清除操作
-func (c *criContainerdService) generateVolumeMounts(containerRootDir string, criMounts []*runtime.Mount, config *imagespec.ImageConfig) []*runtime.Mount {
+func (c *criContainerdService) generateVolumeMounts(containerRootDir, persistentVolumeDir string, criMounts []*runtime.Mount,
+	config *imagespec.ImageConfig) []*runtime.Mount {
 	if len(config.Volumes) == 0 {
 		return nil
 	}
@@ -414,20 +1125,26 @@ func (c *criContainerdService) generateVolumeMounts(containerRootDir string, cri
 		}
 		volumeID := util.GenerateID()
 		src := filepath.Join(containerRootDir, "volumes", volumeID)
+		if persistentVolumeDir != "" {
+			src = filepath.Join(persistentVolumeDir, fmt.Sprintf("%x", sha256.Sum256([]byte(dst))))
+		}
 		// addOCIBindMounts will create these volumes.
 		mounts = append(mounts, &runtime.Mount{
 			ContainerPath: dst,
 			HostPath:      src,
 			// Use default mount propagation.
-			// TODO(random-liu): What about selinux relabel?
+			// Relabel the volume with the container mount label, so that
+			// the container could write into it when selinux is enforcing.
+			SelinuxRelabel: selinux.GetEnabled(),
 		})
 	}
 	return mounts
 }
 
-// generateContainerMounts sets up necessary container mounts including /dev/shm, /etc/hosts
-// and /etc/resolv.conf.
-func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, config *runtime.ContainerConfig) []*runtime.Mount {
+// generateContainerMounts sets up necessary container mounts including /dev/shm, /etc/hosts,
+// /etc/resolv.conf and /etc/localtime.
+func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, config *runtime.ContainerConfig,
+	imageConfig *imagespec.ImageConfig) []*runtime.Mount {
 	var mounts []*runtime.Mount
 	securityContext := config.GetLinux().GetSecurityContext()
 	if !isInCRIMounts(etcHosts, config.GetMounts()) {
@@ -448,7 +1165,9 @@ func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, co
 		})
 	}
 
-	if !isInCRIMounts(devShm, config.GetMounts()) {
+	// An invalid annotation value is reported by configWarnings.
+	skipDevShm, _ := strconv.ParseBool(config.GetAnnotations()[skipDevShmAnnotation])
+	if !skipDevShm && !isInCRIMounts(devShm, config.GetMounts()) {
 		sandboxDevShm := getSandboxDevShm(sandboxRootDir)
 		if securityContext.GetNamespaceOptions().GetHostIpc() {
 			sandboxDevShm = devShm
@@ -459,9 +1178,36 @@ func (c *criContainerdService) generateContainerMounts(sandboxRootDir string, co
 			Readonly:      false,
 		})
 	}
+
+	// Mount host localtime, so that the container inherits host timezone.
+	if MountHostLocaltime && !isInCRIMounts(etcLocaltime, config.GetMounts()) &&
+		!hasTZEnv(config, imageConfig) {
+		if _, err := c.os.Stat(etcLocaltime); err == nil {
+			mounts = append(mounts, &runtime.Mount{
+				ContainerPath: etcLocaltime,
+				HostPath:      etcLocaltime,
+				Readonly:      true,
+			})
+		}
+	}
 	return mounts
 }
 
+// hasTZEnv checks whether TZ environment variable is set in container config or image config.
+func hasTZEnv(config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) bool {
+	for _, e := range config.GetEnvs() {
+		if e.GetKey() == "TZ" {
+			return true
+		}
+	}
+	for _, e := range imageConfig.Env {
+		if strings.HasPrefix(e, "TZ=") {
+			return true
+		}
+	}
+	return false
+}
+
 // setOCIProcessArgs sets process args. It returns error if the final arg list
 // is empty.
 func setOCIProcessArgs(g *generate.Generator, config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) error {
@@ -484,23 +1230,178 @@ func setOCIProcessArgs(g *generate.Generator, config *runtime.ContainerConfig, i
 	return nil
 }
 
-// addImageEnvs adds environment variables from image config. It returns error if
-// an invalid environment variable is encountered.
-func addImageEnvs(g *generate.Generator, imageEnvs []string) error {
-	for _, e := range imageEnvs {
+// setOCIInit runs the process args under the init mounted at containerInitPath.
+func setOCIInit(g *generate.Generator) {
+	args := g.Spec().Process.Args
+	g.SetProcessArgs(append([]string{containerInitPath, "--"}, args...))
+}
+
+// redactedEnvValue replaces the values of masked environment variables in logs.
+const redactedEnvValue = "<redacted>"
+
+// redactSpec returns a copy of the spec for logging, in which the values of
+// environment variables with keys matching any of the glob patterns are redacted.
+// The original spec is not changed.
+func redactSpec(spec *runtimespec.Spec, patterns []string) *runtimespec.Spec {
+	if len(patterns) == 0 || spec.Process == nil {
+		return spec
+	}
+	process := *spec.Process
+	process.Env = make([]string, 0, len(spec.Process.Env))
+	for _, e := range spec.Process.Env {
 		kv := strings.SplitN(e, "=", 2)
-		if len(kv) != 2 {
-			return fmt.Errorf("invalid environment variable %q", e)
+		for _, p := range patterns {
+			if matched, _ := filepath.Match(p, kv[0]); matched {
+				e = kv[0] + "=" + redactedEnvValue
+				break
+			}
 		}
-		g.AddProcessEnv(kv[0], kv[1])
+		process.Env = append(process.Env, e)
+	}
+	redacted := *spec
+	redacted.Process = &process
+	return &redacted
+}
+
+// setOCIProcessEnv sets the environment variables of the container process.
+func setOCIProcessEnv(g *generate.Generator, config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) error {
+	if config.GetTty() {
+		g.AddProcessEnv("TERM", "xterm")
+	}
+
+	// Apply envs from image config first, so that envs from container config
+	// can override them.
+	// 首先应用image config，从而能让container config中的env覆盖它们
+	if err := addImageEnvs(g, imageConfig.Env); err != nil {
+		return err
+	}
+	for _, e := range config.GetEnvs() {
+		g.AddProcessEnv(e.GetKey(), e.GetValue())
+	}
+	return nil
+}
+
+// addOCIPodEnvs adds POD_IP and HOSTNAME environment variables of the pod to the
+// container process, unless they are already set by the image or the container
+// config. They are cri-containerd conveniences, and empty values are not added.
+func addOCIPodEnvs(spec *runtimespec.Spec, ip string) {
+	g := generate.NewFromSpec(spec)
+	for _, e := range []struct {
+		key   string
+		value string
+	}{
+		{"POD_IP", ip},
+		{"HOSTNAME", spec.Hostname},
+	} {
+		if e.value == "" {
+			continue
+		}
+		set := false
+		for _, env := range spec.Process.Env {
+			if strings.SplitN(env, "=", 2)[0] == e.key {
+				set = true
+				break
+			}
+		}
+		if !set {
+			g.AddProcessEnv(e.key, e.value)
+		}
+	}
+}
+
+// EffectiveEnv returns the environment variables the container will run with, in
+// the same order as in the generated spec, without generating the whole spec. It
+// includes the default envs, image envs, and container envs overriding them, but not
+// the pod envs injected at create time.
+func EffectiveEnv(config *runtime.ContainerConfig, imageConfig *imagespec.ImageConfig) ([]string, error) {
+	spec, err := defaultRuntimeSpec(k8sContainerdNamespace, "", false)
+	if err != nil {
+		return nil, err
+	}
+	g := generate.NewFromSpec(spec)
+	if err := setOCIProcessEnv(&g, config, imageConfig); err != nil {
+		return nil, err
+	}
+	return g.Spec().Process.Env, nil
+}
+
+// addImageEnvs adds environment variables from image config. It returns error if
+// an invalid environment variable is encountered.
+func addImageEnvs(g *generate.Generator, imageEnvs []string) error {
+	for _, e := range imageEnvs {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid environment variable %q", e)
+		}
+		g.AddProcessEnv(kv[0], kv[1])
+	}
+	return nil
+}
+
+// setOCIHooks sets the OCI hooks from the node config and the container annotation,
+// both in the JSON format of the OCI runtime spec hooks. Hooks from the node config
+// run first. Hooks run on the host, so every hook path must be an absolute path in
+// allowedPaths.
+func setOCIHooks(g *generate.Generator, defaultHooks, containerHooks string, allowedPaths []string) error {
+	for _, h := range []string{defaultHooks, containerHooks} {
+		if h == "" {
+			continue
+		}
+		var hooks runtimespec.Hooks
+		if err := json.Unmarshal([]byte(h), &hooks); err != nil {
+			return fmt.Errorf("failed to parse hooks %q: %v", h, err)
+		}
+		for _, hs := range [][]runtimespec.Hook{hooks.Prestart, hooks.Poststart, hooks.Poststop} {
+			for _, hook := range hs {
+				if !filepath.IsAbs(hook.Path) {
+					return fmt.Errorf("hook path %q is not an absolute path", hook.Path)
+				}
+				if !util.InStringSlice(allowedPaths, filepath.Clean(hook.Path)) {
+					return fmt.Errorf("hook %q is not allowed", hook.Path)
+				}
+				if hook.Timeout != nil && *hook.Timeout <= 0 {
+					return fmt.Errorf("invalid timeout %d of hook %q", *hook.Timeout, hook.Path)
+				}
+			}
+		}
+		spec := g.Spec()
+		if spec.Hooks == nil {
+			spec.Hooks = &runtimespec.Hooks{}
+		}
+		spec.Hooks.Prestart = append(spec.Hooks.Prestart, hooks.Prestart...)
+		spec.Hooks.Poststart = append(spec.Hooks.Poststart, hooks.Poststart...)
+		spec.Hooks.Poststop = append(spec.Hooks.Poststop, hooks.Poststop...)
 	}
 	return nil
 }
 
-func setOCIPrivileged(g *generate.Generator, config *runtime.ContainerConfig) error {
+// addOCIMaskedPaths adds masked paths on top of the default masked paths. Paths must
+// be absolute, and paths already masked are skipped.
+func addOCIMaskedPaths(g *generate.Generator, paths []string) error {
+	spec := g.Spec()
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("masked path %q is not an absolute path", p)
+		}
+		p = filepath.Clean(p)
+		if util.InStringSlice(spec.Linux.MaskedPaths, p) {
+			continue
+		}
+		spec.Linux.MaskedPaths = append(spec.Linux.MaskedPaths, p)
+	}
+	return nil
+}
+
+// setOCIPrivileged sets all capabilities, privileged mounts and host devices. Host
+// devices are not added if withoutHostDevices is true, in which case the caller adds
+// the requested devices.
+func setOCIPrivileged(g *generate.Generator, config *runtime.ContainerConfig, withoutHostDevices bool) error {
 	// Add all capabilities in privileged mode.
 	g.SetupPrivileged(true)
 	setOCIBindMountsPrivileged(g)
+	if withoutHostDevices {
+		return nil
+	}
 	if err := setOCIDevicesPrivileged(g); err != nil {
 		return fmt.Errorf("failed to set devices mapping %+v: %v", config.GetDevices(), err)
 	}
@@ -517,17 +1418,32 @@ func clearReadOnly(m *runtimespec.Mount) {
 	m.Options = opt
 }
 
-// addDevices set device mapping without privilege.
-func (c *criContainerdService) addOCIDevices(g *generate.Generator, devs []*runtime.Device) error {
+// addDevices set device mapping without privilege. Optional devices which don't exist
+// on the host are skipped.
+func (c *criContainerdService) addOCIDevices(g *generate.Generator, devs []*runtime.Device, optionalDevices []string) error {
 	spec := g.Spec()
 	for _, device := range devs {
 		path, err := c.os.ResolveSymbolicLink(device.HostPath)
+		if err == nil {
+			_, err = c.os.Stat(path)
+		}
+		if err != nil {
+			if os.IsNotExist(err) && util.InStringSlice(optionalDevices, device.HostPath) {
+				glog.Warningf("Skip optional device %q which does not exist on the host", device.HostPath)
+				continue
+			}
+			return deviceError(device.HostPath, err)
+		}
+		allowed, err := isDeviceAllowed(path, c.config.AllowedDevices)
 		if err != nil {
 			return err
 		}
+		if !allowed {
+			return fmt.Errorf("device %q is not allowed", device.HostPath)
+		}
 		dev, err := devices.DeviceFromPath(path, device.Permissions)
 		if err != nil {
-			return err
+			return deviceError(device.HostPath, err)
 		}
 		rd := runtimespec.LinuxDevice{
 			Path:  device.ContainerPath,
@@ -549,6 +1465,36 @@ func (c *criContainerdService) addOCIDevices(g *generate.Generator, devs []*runt
 	return nil
 }
 
+// deviceError returns a descriptive error for a device failed to be added.
+func deviceError(hostPath string, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("device %q does not exist on the host: %v", hostPath, err)
+	case os.IsPermission(err):
+		return fmt.Errorf("permission denied to access device %q: %v", hostPath, err)
+	default:
+		return fmt.Errorf("failed to add device %q: %v", hostPath, err)
+	}
+}
+
+// isDeviceAllowed checks whether a host device path matches any of the allowed
+// device path globs. All devices are allowed if no glob is specified.
+func isDeviceAllowed(path string, allowedDevices []string) (bool, error) {
+	if len(allowedDevices) == 0 {
+		return true, nil
+	}
+	for _, pattern := range allowedDevices {
+		matched, err := filepath.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("invalid allowed device pattern %q: %v", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // addDevices set device mapping with privilege.
 func setOCIDevicesPrivileged(g *generate.Generator) error {
 	spec := g.Spec()
@@ -580,26 +1526,95 @@ func setOCIDevicesPrivileged(g *generate.Generator) error {
 	return nil
 }
 
-// addOCIBindMounts adds bind mounts.
-func (c *criContainerdService) addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, mountLabel string) error {
-	// Mount cgroup into the container as readonly, which inherits docker's behavior.
-	g.AddCgroupsMount("ro") // nolint: errcheck
+// setOCIRootfsPropagation sets the rootfs propagation of the container.
+func setOCIRootfsPropagation(g *generate.Generator, propagation string) error {
+	switch propagation {
+	case "private":
+		// Default rootfs propagation in runc is rprivate.
+		return g.SetLinuxRootPropagation("rprivate")
+	case "slave":
+		return g.SetLinuxRootPropagation("rslave")
+	case "shared":
+		return g.SetLinuxRootPropagation("rshared")
+	default:
+		return fmt.Errorf("invalid rootfs propagation %q", propagation)
+	}
+}
+
+// getMountOptions decodes cri-containerd specific mount options from container annotations.
+func getMountOptions(annotations map[string]string) (map[string]mountOptions, error) {
+	mountOpts := make(map[string]mountOptions)
+	value, ok := annotations[mountOptionsAnnotation]
+	if !ok {
+		return mountOpts, nil
+	}
+	if err := json.Unmarshal([]byte(value), &mountOpts); err != nil {
+		return nil, fmt.Errorf("failed to decode annotation %q: %v", mountOptionsAnnotation, err)
+	}
+	for dst, opts := range mountOpts {
+		switch opts.SelinuxRelabel {
+		case "", selinuxRelabelShared, selinuxRelabelPrivate:
+		default:
+			return nil, fmt.Errorf("invalid selinux relabel mode %q for mount %q", opts.SelinuxRelabel, dst)
+		}
+		switch opts.Type {
+		case "", mountTypeDirectory, mountTypeFile:
+		default:
+			return nil, fmt.Errorf("invalid type %q for mount %q", opts.Type, dst)
+		}
+		for _, o := range opts.Options {
+			if !util.InStringSlice(allowedBindMountOptions, o) {
+				return nil, fmt.Errorf("mount option %q is not allowed for mount %q", o, dst)
+			}
+		}
+	}
+	return mountOpts, nil
+}
+
+// addOCIBindMounts adds bind mounts, and the cgroup mount in cgroupMount mode.
+func (c *criContainerdService) addOCIBindMounts(g *generate.Generator, mounts []*runtime.Mount, mountLabel string,
+	mountOpts map[string]mountOptions, cgroupMount string) error {
+	// Avoid generating a spec too large for the runtime to handle efficiently.
+	if limit := c.config.MaxContainerMounts; limit > 0 && len(mounts) > limit {
+		return fmt.Errorf("number of bind mounts %d exceeds the limit %d", len(mounts), limit)
+	}
+	// Mount cgroup into the container as readonly by default, which inherits
+	// docker's behavior.
+	if cgroupMount != cgroupMountNone {
+		g.AddCgroupsMount(cgroupMount) // nolint: errcheck
+	}
+	// Cache symlink resolution within this call, so that mounts sharing the same
+	// source are only resolved once. It is not shared across calls to avoid stale
+	// results.
+	resolved := make(map[string]string)
+	lookupMount := c.os.LookupMount
+	if c.mountInfo != nil {
+		lookupMount = newMountInfoCache(c.mountInfo).Lookup
+	}
 	for _, mount := range mounts {
 		dst := mount.GetContainerPath()
-		src := mount.GetHostPath()
+		src := resolveMountSource(mount.GetHostPath(), c.config.MountSourceTokens)
 		// Create the host path if it doesn't exist.
 		// TODO(random-liu): Add CRI validation test for this case.
 		if _, err := c.os.Stat(src); err != nil {
 			if !os.IsNotExist(err) {
 				return fmt.Errorf("failed to stat %q: %v", src, err)
 			}
-			if err := c.os.MkdirAll(src, 0755); err != nil {
+			if mountOpts[dst].Type == mountTypeFile {
+				// Create an empty file for single file bind mount.
+				if err := c.os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+					return fmt.Errorf("failed to mkdir %q: %v", filepath.Dir(src), err)
+				}
+				if err := c.os.WriteFile(src, nil, 0644); err != nil {
+					return fmt.Errorf("failed to create file %q: %v", src, err)
+				}
+			} else if err := c.os.MkdirAll(src, 0755); err != nil {
 				return fmt.Errorf("failed to mkdir %q: %v", src, err)
 			}
 		}
 		// TODO(random-liu): Add cri-containerd integration test or cri validation test
 		// for this.
-		src, err := c.os.ResolveSymbolicLink(src)
+		src, err := c.resolveSymbolicLink(src, resolved)
 		if err != nil {
 			return fmt.Errorf("failed to resolve symlink %q: %v", src, err)
 		}
@@ -611,13 +1626,13 @@ func (c *criContainerdService) addOCIBindMounts(g *generate.Generator, mounts []
 			// Since default root propogation in runc is rprivate ignore
 			// setting the root propagation
 		case runtime.MountPropagation_PROPAGATION_BIDIRECTIONAL:
-			if err := ensureShared(src, c.os.LookupMount); err != nil {
+			if err := ensureShared(src, lookupMount); err != nil {
 				return err
 			}
 			options = append(options, "rshared")
 			g.SetLinuxRootPropagation("rshared") // nolint: errcheck
 		case runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
-			if err := ensureSharedOrSlave(src, c.os.LookupMount); err != nil {
+			if err := ensureSharedOrSlave(src, lookupMount); err != nil {
 				return err
 			}
 			options = append(options, "rslave")
@@ -637,9 +1652,16 @@ func (c *criContainerdService) addOCIBindMounts(g *generate.Generator, mounts []
 		} else {
 			options = append(options, "rw")
 		}
+		options = append(options, c.restrictedMountOptions()...)
+		options = append(options, mountOpts[dst].Options...)
 
-		if mount.GetSelinuxRelabel() {
-			if err := label.Relabel(src, mountLabel, true); err != nil && err != unix.ENOTSUP {
+		// CRI SelinuxRelabel relabels the mount private to the container by default.
+		relabel := mountOpts[dst].SelinuxRelabel
+		if relabel == "" && mount.GetSelinuxRelabel() {
+			relabel = selinuxRelabelPrivate
+		}
+		if relabel != "" {
+			if err := label.Relabel(src, mountLabel, relabel == selinuxRelabelShared); err != nil && err != unix.ENOTSUP {
 				return fmt.Errorf("relabel %q with %q failed: %v", src, mountLabel, err)
 			}
 		}
@@ -649,6 +1671,97 @@ func (c *criContainerdService) addOCIBindMounts(g *generate.Generator, mounts []
 	return nil
 }
 
+// validateMounts validates the CRI mounts, and returns a single error listing all
+// problems found. Unknown propagation modes are not errors, they are reported by
+// configWarnings and rprivate is used.
+func validateMounts(mounts []*runtime.Mount) error {
+	var problems []string
+	for i, m := range mounts {
+		dst := m.GetContainerPath()
+		switch {
+		case dst == "":
+			problems = append(problems, fmt.Sprintf("mount %d has empty container path", i))
+		case !filepath.IsAbs(dst):
+			problems = append(problems, fmt.Sprintf("container path %q of mount %d is not absolute", dst, i))
+		case filepath.Clean(dst) == "/":
+			problems = append(problems, fmt.Sprintf("mount %d can't be mounted over the root filesystem", i))
+		}
+		if m.GetHostPath() == "" {
+			problems = append(problems, fmt.Sprintf("mount %d at %q has empty host path", i, dst))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid mounts: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// addOCIWritablePaths adds tmpfs mounts for the paths, so that they are writable
+// when the root filesystem is readonly. Paths already mounted are skipped.
+func addOCIWritablePaths(g *generate.Generator, paths []string) {
+	spec := g.Spec()
+	for _, path := range paths {
+		mounted := false
+		for _, m := range spec.Mounts {
+			if filepath.Clean(m.Destination) == filepath.Clean(path) {
+				mounted = true
+				break
+			}
+		}
+		if mounted {
+			continue
+		}
+		spec.Mounts = append(spec.Mounts, runtimespec.Mount{
+			Destination: path,
+			Type:        "tmpfs",
+			Source:      "tmpfs",
+			Options:     []string{"nosuid", "nodev", "mode=1777"},
+		})
+	}
+}
+
+// mountSourceTokenPrefix is the prefix of symbolic mount source tokens.
+const mountSourceTokenPrefix = "@"
+
+// resolveMountSource resolves the symbolic host path token, e.g. "@hostrun", to the
+// configured absolute path. Unknown tokens are returned as literal paths.
+func resolveMountSource(src string, tokens map[string]string) string {
+	if !strings.HasPrefix(src, mountSourceTokenPrefix) {
+		return src
+	}
+	if path, ok := tokens[strings.TrimPrefix(src, mountSourceTokenPrefix)]; ok {
+		return path
+	}
+	return src
+}
+
+// resolveSymbolicLink resolves the path with the cache, and adds the result
+// into the cache.
+func (c *criContainerdService) resolveSymbolicLink(path string, cache map[string]string) (string, error) {
+	if resolved, ok := cache[path]; ok {
+		return resolved, nil
+	}
+	resolved, err := c.os.ResolveSymbolicLink(path)
+	if err != nil {
+		return "", err
+	}
+	cache[path] = resolved
+	return resolved, nil
+}
+
+// restrictedMountOptions returns the mount options enforced on all volume and bind
+// mounts by the node config.
+func (c *criContainerdService) restrictedMountOptions() []string {
+	var options []string
+	if c.config.RestrictMounts {
+		options = append(options, "nosuid", "nodev")
+	}
+	if c.config.NoExecMounts {
+		options = append(options, "noexec")
+	}
+	return options
+}
+
 func setOCIBindMountsPrivileged(g *generate.Generator) {
 	spec := g.Spec()
 	// clear readonly for /sys and cgroup
@@ -665,13 +1778,17 @@ func setOCIBindMountsPrivileged(g *generate.Generator) {
 }
 
 // setOCILinuxResource set container resource limit.
-func setOCILinuxResource(g *generate.Generator, resources *runtime.LinuxContainerResources) {
+func setOCILinuxResource(g *generate.Generator, resources *runtime.LinuxContainerResources, cgroupV2 bool) {
 	if resources == nil {
 		return
 	}
 	g.SetLinuxResourcesCPUPeriod(uint64(resources.GetCpuPeriod()))
 	g.SetLinuxResourcesCPUQuota(resources.GetCpuQuota())
-	g.SetLinuxResourcesCPUShares(uint64(resources.GetCpuShares()))
+	shares := uint64(resources.GetCpuShares())
+	if cgroupV2 {
+		shares = cgroupV2CPUShares(shares)
+	}
+	g.SetLinuxResourcesCPUShares(shares)
 	g.SetLinuxResourcesMemoryLimit(resources.GetMemoryLimitInBytes())
 	g.SetProcessOOMScoreAdj(int(resources.GetOomScoreAdj()))
 	g.SetLinuxResourcesCPUCpus(resources.GetCpusetCpus())
@@ -690,11 +1807,93 @@ func getOCICapabilitiesList() []string {
 	return caps
 }
 
+// validateCapabilities checks the capabilities in CRI format are known, and suggests
+// the closest known capability for an unknown one, which is most likely a typo.
+func validateCapabilities(capabilities []string) error {
+	known := getOCICapabilitiesList()
+	for _, c := range capabilities {
+		if strings.ToUpper(c) == "ALL" {
+			continue
+		}
+		cap := "CAP_" + strings.ToUpper(c)
+		if util.InStringSlice(known, cap) {
+			continue
+		}
+		if closest := closestString(cap, known); closest != "" {
+			return fmt.Errorf("unknown capability %q, did you mean %q?", c, strings.TrimPrefix(closest, "CAP_"))
+		}
+		return fmt.Errorf("unknown capability %q", c)
+	}
+	return nil
+}
+
+// closestString returns the candidate with the minimum edit distance to s. Empty
+// is returned if there is no candidate.
+func closestString(s string, candidates []string) string {
+	closest, min := "", -1
+	for _, c := range candidates {
+		if d := editDistance(s, c); min < 0 || d < min {
+			closest, min = c, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// setOCIDefaultCapabilities replaces the default process capabilities of the runtime
+// spec with the specified capabilities, which are in CRI format without `CAP_` prefix.
+// The default capabilities of the runtime spec are kept if none is specified.
+func setOCIDefaultCapabilities(g *generate.Generator, capabilities []string) error {
+	if len(capabilities) == 0 {
+		return nil
+	}
+	g.ClearProcessCapabilities()
+	for _, c := range capabilities {
+		if err := g.AddProcessCapability("CAP_" + strings.ToUpper(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // setOCICapabilities adds/drops process capabilities.
 func setOCICapabilities(g *generate.Generator, capabilities *runtime.Capability) error {
 	if capabilities == nil {
 		return nil
 	}
+	if err := validateCapabilities(capabilities.GetAddCapabilities()); err != nil {
+		return err
+	}
+	if err := validateCapabilities(capabilities.GetDropCapabilities()); err != nil {
+		return err
+	}
 
 	// Add/drop all capabilities if "all" is specified, so that
 	// following individual add/drop could still work. E.g.
@@ -736,6 +1935,160 @@ func setOCICapabilities(g *generate.Generator, capabilities *runtime.Capability)
 	return nil
 }
 
+// addOCIImageLabelAnnotations adds image labels with any of the prefixes as spec
+// annotations, e.g. to expose image provenance to downstream tooling.
+func addOCIImageLabelAnnotations(g *generate.Generator, labels map[string]string, prefixes []string) {
+	spec := g.Spec()
+	for k, v := range labels {
+		for _, p := range prefixes {
+			if !strings.HasPrefix(k, p) {
+				continue
+			}
+			if spec.Annotations == nil {
+				spec.Annotations = make(map[string]string)
+			}
+			spec.Annotations[k] = v
+			break
+		}
+	}
+}
+
+// procMountOptions are the supported /proc mount options, and whether each requires
+// the procfs mount options added in linux 5.8.
+var procMountOptions = map[string]bool{
+	"hidepid=0":          false,
+	"hidepid=1":          false,
+	"hidepid=2":          false,
+	"hidepid=off":        true,
+	"hidepid=noaccess":   true,
+	"hidepid=invisible":  true,
+	"hidepid=ptraceable": true,
+	"subset=pid":         true,
+}
+
+// setOCIProcMountOptions adds the options to the /proc mount. Options not supported
+// by the kernel are dropped with a warning, so that the container can still start.
+func setOCIProcMountOptions(g *generate.Generator, options []string, v2Supported bool) error {
+	var supported []string
+	for _, o := range options {
+		needV2, ok := procMountOptions[o]
+		if !ok {
+			return fmt.Errorf("unsupported /proc mount option %q", o)
+		}
+		if needV2 && !v2Supported {
+			glog.Warningf("Drop /proc mount option %q which is not supported by the kernel", o)
+			continue
+		}
+		supported = append(supported, o)
+	}
+	if len(supported) == 0 {
+		return nil
+	}
+	spec := g.Spec()
+	for i := range spec.Mounts {
+		if spec.Mounts[i].Destination == "/proc" {
+			spec.Mounts[i].Options = append(spec.Mounts[i].Options, supported...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no /proc mount")
+}
+
+// rlimitNames are the supported rlimit names.
+var rlimitNames = []string{
+	"as", "core", "cpu", "data", "fsize", "locks", "memlock", "msgqueue",
+	"nice", "nofile", "nproc", "rss", "rtprio", "rttime", "sigpending", "stack",
+}
+
+// setOCIRlimits sets the rlimits of the container process. Node defaults are applied
+// first, then rlimits from the image label and the container annotation, so that
+// the latter override the former.
+func setOCIRlimits(g *generate.Generator, defaults []string, imageRlimits, containerRlimits string) error {
+	rlimits := append([]string{}, defaults...)
+	for _, r := range []string{imageRlimits, containerRlimits} {
+		if r != "" {
+			rlimits = append(rlimits, strings.Split(r, ",")...)
+		}
+	}
+	for _, r := range rlimits {
+		rlimit, err := parseRlimit(r)
+		if err != nil {
+			return err
+		}
+		g.AddProcessRlimits(rlimit.Type, rlimit.Hard, rlimit.Soft)
+	}
+	return nil
+}
+
+// parseRlimit parses rlimit in "name=soft[:hard]" format. Hard limit defaults to
+// the soft limit.
+func parseRlimit(rlimit string) (runtimespec.POSIXRlimit, error) {
+	kv := strings.SplitN(rlimit, "=", 2)
+	if len(kv) != 2 {
+		return runtimespec.POSIXRlimit{}, fmt.Errorf("invalid rlimit %q", rlimit)
+	}
+	if !util.InStringSlice(rlimitNames, kv[0]) {
+		return runtimespec.POSIXRlimit{}, fmt.Errorf("unknown rlimit %q", kv[0])
+	}
+	limits := strings.SplitN(kv[1], ":", 2)
+	soft, err := strconv.ParseUint(limits[0], 10, 64)
+	if err != nil {
+		return runtimespec.POSIXRlimit{}, fmt.Errorf("invalid soft limit in rlimit %q: %v", rlimit, err)
+	}
+	hard := soft
+	if len(limits) == 2 {
+		if hard, err = strconv.ParseUint(limits[1], 10, 64); err != nil {
+			return runtimespec.POSIXRlimit{}, fmt.Errorf("invalid hard limit in rlimit %q: %v", rlimit, err)
+		}
+	}
+	if soft > hard {
+		return runtimespec.POSIXRlimit{}, fmt.Errorf("soft limit exceeds hard limit in rlimit %q", rlimit)
+	}
+	return runtimespec.POSIXRlimit{
+		Type: "RLIMIT_" + strings.ToUpper(kv[0]),
+		Hard: hard,
+		Soft: soft,
+	}, nil
+}
+
+// setOCIAmbientCapabilities sets the ambient capabilities of the process, which are in
+// CRI format without `CAP_` prefix. The kernel only keeps ambient capabilities which are
+// both permitted and inheritable, so any other capability is rejected.
+// NOTE: No new privileges doesn't need to be cleared. The kernel clears ambient
+// capabilities on exec of a set-user-ID or file capability binary, and no new
+// privileges only stops such a binary from gaining privileges. Ambient capabilities
+// are kept across exec of other binaries either way.
+func setOCIAmbientCapabilities(g *generate.Generator, capabilities []string) error {
+	caps := g.Spec().Process.Capabilities
+	if caps == nil {
+		return fmt.Errorf("no process capabilities")
+	}
+	var ambient []string
+	for _, c := range capabilities {
+		c = "CAP_" + strings.ToUpper(strings.TrimSpace(c))
+		if !util.InStringSlice(caps.Permitted, c) || !util.InStringSlice(caps.Inheritable, c) {
+			return fmt.Errorf("capability %q is not in both permitted and inheritable sets", c)
+		}
+		if !util.InStringSlice(ambient, c) {
+			ambient = append(ambient, c)
+		}
+	}
+	caps.Ambient = ambient
+	return nil
+}
+
+// sortOCICapabilities sorts all capability sets of the process, so that the generated
+// spec is the same for the same container config.
+func sortOCICapabilities(g *generate.Generator) {
+	caps := g.Spec().Process.Capabilities
+	if caps == nil {
+		return
+	}
+	for _, c := range [][]string{caps.Bounding, caps.Effective, caps.Inheritable, caps.Permitted, caps.Ambient} {
+		sort.Strings(c)
+	}
+}
+
 // setOCINamespaces sets namespaces.
 func setOCINamespaces(g *generate.Generator, namespaces *runtime.NamespaceOption, sandboxPid uint32) {
 	// 共享network, ipc以及uts namespace
@@ -749,11 +2102,47 @@ func setOCINamespaces(g *generate.Generator, namespaces *runtime.NamespaceOption
 	}
 }
 
+// setOCIKeepIDUserNamespace runs the container in a new user namespace, which maps
+// the container root to the host uid and gid, e.g. the uid running rootless containerd.
+// Only the container root is mapped, see customopts.WithUserMappingCheck. It returns
+// an error for host root, which would map the container root to host root without
+// any isolation.
+func setOCIKeepIDUserNamespace(g *generate.Generator, uid, gid uint32) error {
+	if uid == 0 {
+		return fmt.Errorf("keep id user namespace is not supported when running as root")
+	}
+	g.AddOrReplaceLinuxNamespace(string(runtimespec.UserNamespace), "") // nolint: errcheck
+	g.ClearLinuxUIDMappings()
+	g.ClearLinuxGIDMappings()
+	g.AddLinuxUIDMapping(uid, 0, 1)
+	g.AddLinuxGIDMapping(gid, 0, 1)
+	return nil
+}
+
+// validateSpec validates the generated runtime spec with runtime-tools. The root
+// filesystem is not checked, because it is not prepared yet.
+func validateSpec(spec *runtimespec.Spec) error {
+	v := validate.NewValidator(spec, "", false, "linux")
+	for _, check := range []func() error{
+		v.CheckSemVer,
+		v.CheckMandatoryFields,
+		v.CheckProcess,
+		v.CheckMounts,
+		v.CheckLinux,
+	} {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // defaultRuntimeSpec returns a default runtime spec used in cri-containerd.
-func defaultRuntimeSpec(id string) (*runtimespec.Spec, error) {
+// The default `/run` tmpfs mount is removed unless keepRunMount is true.
+func defaultRuntimeSpec(namespace, id string, keepRunMount bool) (*runtimespec.Spec, error) {
 	// GenerateSpec needs namespace.
-	// k8sContainerdNamespace中表示的是我们用于连接containerd使用的namespace
-	ctx := namespaces.WithNamespace(context.Background(), k8sContainerdNamespace)
+	// namespace中表示的是我们用于连接containerd使用的namespace
+	ctx := namespaces.WithNamespace(context.Background(), namespace)
 	spec, err := containerd.GenerateSpec(ctx, nil, &containers.Container{ID: id})
 	if err != nil {
 		return nil, err
@@ -762,14 +2151,16 @@ func defaultRuntimeSpec(id string) (*runtimespec.Spec, error) {
 	// Remove `/run` mount
 	// TODO(random-liu): Mount tmpfs for /run and handle copy-up.
 	// 去除`/run`的mount，在/run挂载tmpfs并且处理copy-up
-	var mounts []runtimespec.Mount
-	for _, mount := range spec.Mounts {
-		if mount.Destination == "/run" {
-			continue
+	if !keepRunMount {
+		var mounts []runtimespec.Mount
+		for _, mount := range spec.Mounts {
+			if mount.Destination == "/run" {
+				continue
+			}
+			mounts = append(mounts, mount)
 		}
-		mounts = append(mounts, mount)
+		spec.Mounts = mounts
 	}
-	spec.Mounts = mounts
 
 	// Make sure no default seccomp/apparmor is specified
 	// 确保不指定默认的seccomp/apparmor
@@ -801,12 +2192,21 @@ func generateSeccompSpecOpts(seccompProf string, privileged, seccompEnabled bool
 	}
 	switch seccompProf {
 	case "", unconfinedProfile:
-		// Do not set seccomp profile.
+		// Do not set seccomp profile. Unconfined is the same as unset, and
+		// doesn't change no-new-privileges, which is only decided by the
+		// NoNewPrivs of the security context in generateContainerSpec.
 		return nil, nil
 	case dockerDefault:
 		// Note: WithDefaultProfile specOpts must be added after capabilities
 		return seccomp.WithDefaultProfile(), nil
 	default:
+		if strings.HasPrefix(seccompProf, inlineProfilePrefix) {
+			profile, err := parseInlineSeccompProfile(strings.TrimPrefix(seccompProf, inlineProfilePrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid inline seccomp profile: %v", err)
+			}
+			return withSeccompProfile(profile), nil
+		}
 		// Require and Trim default profile name prefix
 		if !strings.HasPrefix(seccompProf, profileNamePrefix) {
 			return nil, fmt.Errorf("invalid seccomp profile %q", seccompProf)
@@ -815,8 +2215,132 @@ func generateSeccompSpecOpts(seccompProf string, privileged, seccompEnabled bool
 	}
 }
 
-// generateApparmorSpecOpts generates containerd SpecOpts for apparmor.
-func generateApparmorSpecOpts(apparmorProf string, privileged, apparmorEnabled bool) (containerd.SpecOpts, error) {
+// withAllowedSyscalls allows the syscalls on top of the seccomp profile applied by
+// previous SpecOpts. Only the named syscalls are allowed, the rest of the profile is
+// not changed.
+func withAllowedSyscalls(syscalls []string) (containerd.SpecOpts, error) {
+	for _, name := range syscalls {
+		if name == "" || strings.TrimFunc(name, func(r rune) bool {
+			return r == '_' || unicode.IsDigit(r) || unicode.IsLower(r)
+		}) != "" {
+			return nil, fmt.Errorf("invalid syscall name %q", name)
+		}
+	}
+	return func(_ context.Context, _ *containerd.Client, _ *containers.Container, s *runtimespec.Spec) error {
+		if s.Linux.Seccomp == nil {
+			return fmt.Errorf("no seccomp profile to allow syscalls %v", syscalls)
+		}
+		if s.Linux.Seccomp.DefaultAction == runtimespec.ActAllow {
+			return nil
+		}
+		s.Linux.Seccomp.Syscalls = append(s.Linux.Seccomp.Syscalls, runtimespec.LinuxSyscall{
+			Names:  syscalls,
+			Action: runtimespec.ActAllow,
+		})
+		return nil
+	}, nil
+}
+
+// supportedSeccompActions are the seccomp actions allowed in an inline seccomp profile.
+var supportedSeccompActions = []runtimespec.LinuxSeccompAction{
+	runtimespec.ActKill,
+	runtimespec.ActTrap,
+	runtimespec.ActErrno,
+	runtimespec.ActTrace,
+	runtimespec.ActAllow,
+}
+
+// parseInlineSeccompProfile decodes an inline seccomp profile, which is either raw
+// JSON or base64 encoded JSON. The profile must be a single JSON object within
+// maxInlineSeccompProfileSize, with a default action and only supported actions.
+func parseInlineSeccompProfile(content string) (*runtimespec.LinuxSeccomp, error) {
+	data := []byte(content)
+	if !strings.HasPrefix(strings.TrimSpace(content), "{") {
+		if base64.StdEncoding.DecodedLen(len(content)) > maxInlineSeccompProfileSize {
+			return nil, fmt.Errorf("profile size exceeds the limit %d", maxInlineSeccompProfileSize)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode base64 profile: %v", err)
+		}
+		data = decoded
+	}
+	if len(data) > maxInlineSeccompProfileSize {
+		return nil, fmt.Errorf("profile size %d exceeds the limit %d", len(data), maxInlineSeccompProfileSize)
+	}
+	var profile runtimespec.LinuxSeccomp
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to decode profile: %v", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after profile")
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("no default action in profile")
+	}
+	if !isSeccompActionSupported(profile.DefaultAction) {
+		return nil, fmt.Errorf("unsupported default action %q", profile.DefaultAction)
+	}
+	for _, s := range profile.Syscalls {
+		if len(s.Names) == 0 {
+			return nil, fmt.Errorf("no syscall names in rule with action %q", s.Action)
+		}
+		if !isSeccompActionSupported(s.Action) {
+			return nil, fmt.Errorf("unsupported action %q for syscalls %v", s.Action, s.Names)
+		}
+	}
+	return &profile, nil
+}
+
+func isSeccompActionSupported(action runtimespec.LinuxSeccompAction) bool {
+	for _, a := range supportedSeccompActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// withSeccompProfile sets the seccomp profile of the container.
+func withSeccompProfile(profile *runtimespec.LinuxSeccomp) containerd.SpecOpts {
+	return func(_ context.Context, _ *containerd.Client, _ *containers.Container, s *runtimespec.Spec) error {
+		s.Linux.Seccomp = profile
+		return nil
+	}
+}
+
+// checkSeccompProfileSupported checks whether a localhost seccomp profile only uses
+// actions supported by the runtime. Profiles with SCMP_ACT_NOTIFY are rejected, because
+// the runtime spec in use has no seccomp listener to deliver the notifications to, and
+// the container would otherwise fail obscurely at start.
+func checkSeccompProfileSupported(seccompProf string) error {
+	if !strings.HasPrefix(seccompProf, profileNamePrefix) {
+		return nil
+	}
+	path := strings.TrimPrefix(seccompProf, profileNamePrefix)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read seccomp profile %q: %v", path, err)
+	}
+	var profile runtimespec.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return fmt.Errorf("failed to decode seccomp profile %q: %v", path, err)
+	}
+	if profile.DefaultAction == seccompActNotify {
+		return fmt.Errorf("seccomp action %q is not supported", seccompActNotify)
+	}
+	for _, s := range profile.Syscalls {
+		if s.Action == seccompActNotify {
+			return fmt.Errorf("seccomp action %q for syscalls %v is not supported", seccompActNotify, s.Names)
+		}
+	}
+	return nil
+}
+
+// generateApparmorSpecOpts generates containerd SpecOpts for apparmor. defaultPolicy
+// decides what to do when the default apparmor profile fails to be applied.
+func generateApparmorSpecOpts(apparmorProf string, privileged, apparmorEnabled bool, defaultPolicy string) (containerd.SpecOpts, error) {
 	if !apparmorEnabled {
 		// Should fail loudly if user try to specify apparmor profile
 		// but we don't support it.
@@ -830,7 +2354,7 @@ func generateApparmorSpecOpts(apparmorProf string, privileged, apparmorEnabled b
 	case runtimeDefault:
 		// TODO (mikebrow): delete created apparmor default profile
 		// 创建默认的profile name
-		return apparmor.WithDefaultProfile(appArmorDefaultProfileName), nil
+		return defaultApparmorSpecOpts(defaultPolicy)
 	case unconfinedProfile:
 		return nil, nil
 	case "":
@@ -841,7 +2365,7 @@ func generateApparmorSpecOpts(apparmorProf string, privileged, apparmorEnabled b
 			// 如果是privileged container直接返回nil
 			return nil, nil
 		}
-		return apparmor.WithDefaultProfile(appArmorDefaultProfileName), nil
+		return defaultApparmorSpecOpts(defaultPolicy)
 	default:
 		// Require and Trim default profile name prefix
 		if !strings.HasPrefix(apparmorProf, profileNamePrefix) {
@@ -852,6 +2376,31 @@ func generateApparmorSpecOpts(apparmorProf string, privileged, apparmorEnabled b
 	}
 }
 
+// defaultApparmorSpecOpts generates containerd SpecOpts for the default apparmor
+// profile with the specified failure policy.
+func defaultApparmorSpecOpts(policy string) (containerd.SpecOpts, error) {
+	switch policy {
+	case "", apparmorPolicyFail:
+		return apparmor.WithDefaultProfile(appArmorDefaultProfileName), nil
+	case apparmorPolicyUnconfined:
+		return withApparmorFallback(apparmor.WithDefaultProfile(appArmorDefaultProfileName)), nil
+	default:
+		return nil, fmt.Errorf("unknown apparmor default profile policy %q", policy)
+	}
+}
+
+// withApparmorFallback wraps the apparmor SpecOpts, and leaves the container
+// unconfined with a warning if the profile fails to be applied.
+func withApparmorFallback(opts containerd.SpecOpts) containerd.SpecOpts {
+	return func(ctx context.Context, client *containerd.Client, c *containers.Container, s *runtimespec.Spec) error {
+		if err := opts(ctx, client, c, s); err != nil {
+			glog.Warningf("Failed to apply apparmor profile for container %q, fall back to unconfined: %v", c.ID, err)
+			s.Process.ApparmorProfile = ""
+		}
+		return nil
+	}
+}
+
 // Ensure mount point on which path is mounted, is shared.
 func ensureShared(path string, lookupMount func(string) (mount.Info, error)) error {
 	mountInfo, err := lookupMount(path)
@@ -17,22 +17,33 @@ limitations under the License.
 package server
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/containers"
 	"github.com/containerd/containerd/contrib/apparmor"
 	"github.com/containerd/containerd/contrib/seccomp"
 	"github.com/containerd/containerd/mount"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
+	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
+	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/util"
 )
 
@@ -77,12 +88,12 @@ func getCreateContainerTestData() (*runtime.ContainerConfig, *runtime.PodSandbox
 		Mounts: []*runtime.Mount{
 			// everything default
 			{
-				ContainerPath: "container-path-1",
+				ContainerPath: "/container-path-1",
 				HostPath:      "host-path-1",
 			},
 			// readOnly
 			{
-				ContainerPath: "container-path-2",
+				ContainerPath: "/container-path-2",
 				HostPath:      "host-path-2",
 				Readonly:      true,
 			},
@@ -133,8 +144,8 @@ func getCreateContainerTestData() (*runtime.ContainerConfig, *runtime.PodSandbox
 		checkMount(t, spec.Mounts, "cgroup", "/sys/fs/cgroup", "cgroup", []string{"ro"}, nil)
 
 		t.Logf("Check bind mount")
-		checkMount(t, spec.Mounts, "host-path-1", "container-path-1", "bind", []string{"rbind", "rprivate", "rw"}, nil)
-		checkMount(t, spec.Mounts, "host-path-2", "container-path-2", "bind", []string{"rbind", "rprivate", "ro"}, nil)
+		checkMount(t, spec.Mounts, "host-path-1", "/container-path-1", "bind", []string{"rbind", "rprivate", "rw"}, nil)
+		checkMount(t, spec.Mounts, "host-path-2", "/container-path-2", "bind", []string{"rbind", "rprivate", "ro"}, nil)
 
 		t.Logf("Check resource limits")
 		assert.EqualValues(t, *spec.Linux.Resources.CPU.Period, 100)
@@ -177,11 +188,43 @@ func TestGeneralContainerSpec(t *testing.T) {
 	testPid := uint32(1234)
 	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
 	c := newTestCRIContainerdService()
-	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
 	require.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 }
 
+func TestApplySpecMutators(t *testing.T) {
+	defer func() { specMutators = nil }()
+	var order []string
+	RegisterSpecMutator(func(spec *runtimespec.Spec) error {
+		order = append(order, "first")
+		spec.Hostname = "mutated"
+		return nil
+	})
+	RegisterSpecMutator(func(spec *runtimespec.Spec) error {
+		order = append(order, "second")
+		return nil
+	})
+	spec := &runtimespec.Spec{}
+	require.NoError(t, applySpecMutators(spec))
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, "mutated", spec.Hostname)
+
+	t.Logf("should stop at the first error")
+	order = nil
+	specMutators = nil
+	RegisterSpecMutator(func(*runtimespec.Spec) error {
+		order = append(order, "first")
+		return errors.New("test error")
+	})
+	RegisterSpecMutator(func(*runtimespec.Spec) error {
+		order = append(order, "second")
+		return nil
+	})
+	assert.Error(t, applySpecMutators(spec))
+	assert.Equal(t, []string{"first"}, order)
+}
+
 func TestContainerCapabilities(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
@@ -230,57 +273,1065 @@ func TestContainerCapabilities(t *testing.T) {
 		},
 	} {
 		t.Logf("TestCase %q", desc)
-		config.Linux.SecurityContext.Capabilities = test.capability
-		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+		config.Linux.SecurityContext.Capabilities = test.capability
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		require.NoError(t, err)
+		specCheck(t, testID, testPid, spec)
+		t.Log(spec.Process.Capabilities.Bounding)
+		for _, include := range test.includes {
+			assert.Contains(t, spec.Process.Capabilities.Bounding, include)
+			assert.Contains(t, spec.Process.Capabilities.Effective, include)
+			assert.Contains(t, spec.Process.Capabilities.Inheritable, include)
+			assert.Contains(t, spec.Process.Capabilities.Permitted, include)
+		}
+		for _, exclude := range test.excludes {
+			assert.NotContains(t, spec.Process.Capabilities.Bounding, exclude)
+			assert.NotContains(t, spec.Process.Capabilities.Effective, exclude)
+			assert.NotContains(t, spec.Process.Capabilities.Inheritable, exclude)
+			assert.NotContains(t, spec.Process.Capabilities.Permitted, exclude)
+		}
+	}
+}
+
+func TestContainerDefaultCapabilities(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	config.Linux.SecurityContext.Capabilities = &runtime.Capability{
+		AddCapabilities:  []string{"SYS_ADMIN"},
+		DropCapabilities: []string{"CHOWN"},
+	}
+	c := newTestCRIContainerdService()
+	c.config.DefaultCapabilities = []string{"CHOWN", "KILL"}
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	specCheck(t, testID, testPid, spec)
+	expected := []string{"CAP_KILL", "CAP_SYS_ADMIN"}
+	for _, caps := range [][]string{
+		spec.Process.Capabilities.Bounding,
+		spec.Process.Capabilities.Effective,
+		spec.Process.Capabilities.Inheritable,
+		spec.Process.Capabilities.Permitted,
+	} {
+		assert.Equal(t, expected, caps)
+	}
+}
+
+func TestContainerCapabilitiesSorted(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Linux.SecurityContext.Capabilities = &runtime.Capability{
+		AddCapabilities: []string{"SYS_ADMIN", "NET_ADMIN"},
+	}
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	for _, caps := range [][]string{
+		spec.Process.Capabilities.Bounding,
+		spec.Process.Capabilities.Effective,
+		spec.Process.Capabilities.Inheritable,
+		spec.Process.Capabilities.Permitted,
+	} {
+		assert.True(t, sort.StringsAreSorted(caps), "capabilities %v should be sorted", caps)
+	}
+}
+
+func TestContainerAmbientCapabilities(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		add        []string
+		ambient    string
+		noNewPrivs bool
+		expected   []string
+		expectErr  bool
+	}{
+		"should set ambient capabilities": {
+			add:      []string{"NET_BIND_SERVICE", "NET_RAW"},
+			ambient:  "NET_RAW,net_bind_service",
+			expected: []string{"CAP_NET_BIND_SERVICE", "CAP_NET_RAW"},
+		},
+		"should keep no new privileges with ambient capabilities": {
+			add:        []string{"NET_BIND_SERVICE"},
+			ambient:    "NET_BIND_SERVICE",
+			noNewPrivs: true,
+			expected:   []string{"CAP_NET_BIND_SERVICE"},
+		},
+		"should return error for capability not in inheritable set": {
+			ambient:   "SYS_ADMIN",
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Annotations = map[string]string{ambientCapabilitiesAnnotation: test.ambient}
+		config.Linux.SecurityContext.NoNewPrivs = test.noNewPrivs
+		config.Linux.SecurityContext.Capabilities = &runtime.Capability{
+			AddCapabilities:  test.add,
+			DropCapabilities: []string{"SYS_ADMIN"},
+		}
+		c := newTestCRIContainerdService()
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Process.Capabilities.Ambient)
+		assert.Equal(t, test.noNewPrivs, spec.Process.NoNewPrivileges)
+	}
+}
+
+func TestContainerSpecExtraMaskedPaths(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	c.config.ExtraMaskedPaths = []string{"/proc/test", "/sys/firmware/", "/proc/test"}
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	for _, p := range []string{"/proc/test", "/sys/firmware"} {
+		count := 0
+		for _, m := range spec.Linux.MaskedPaths {
+			if m == p {
+				count++
+			}
+		}
+		assert.Equal(t, 1, count, "%q should be masked once", p)
+	}
+
+	t.Logf("masked paths should be cleared for privileged container")
+	config.Linux.SecurityContext.Privileged = true
+	sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: true}
+	spec, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, spec.Linux.MaskedPaths)
+
+	t.Logf("should return error for relative masked path")
+	config.Linux.SecurityContext.Privileged = false
+	c.config.ExtraMaskedPaths = []string{"proc/test"}
+	_, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestContainerSpecDefaultWorkingDir(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		configDir  string
+		imageDir   string
+		defaultDir string
+		expected   string
+	}{
+		"should use container config working dir": {
+			configDir:  "/config",
+			imageDir:   "/image",
+			defaultDir: "/default",
+			expected:   "/config",
+		},
+		"should use image working dir": {
+			imageDir:   "/image",
+			defaultDir: "/default",
+			expected:   "/image",
+		},
+		"should use default working dir when neither is set": {
+			defaultDir: "/default",
+			expected:   "/default",
+		},
+		"should use / without default working dir": {
+			expected: "/",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.WorkingDir = test.configDir
+		imageConfig.WorkingDir = test.imageDir
+		c := newTestCRIContainerdService()
+		c.config.DefaultWorkingDir = test.defaultDir
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Process.Cwd)
+	}
+}
+
+func TestContainerSpecSupplementalGroups(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+		SupplementalGroups: []int64{2000, 1000},
+	}
+	config.Linux.SecurityContext.SupplementalGroups = []int64{1000, 3000}
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{2000, 1000, 3000}, spec.Process.User.AdditionalGids)
+}
+
+func TestContainerSpecTty(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	for _, tty := range []bool{true, false} {
+		config.Tty = tty
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		require.NoError(t, err)
+		specCheck(t, testID, testPid, spec)
+		assert.Equal(t, tty, spec.Process.Terminal)
+		if tty {
+			assert.Contains(t, spec.Process.Env, "TERM=xterm")
+		} else {
+			assert.NotContains(t, spec.Process.Env, "TERM=xterm")
+		}
+	}
+}
+
+func TestContainerSpecReadonlyRootfs(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	c.config.ReadonlyRootfsWritablePaths = []string{"/tmp", "/dev"}
+	for _, readonly := range []bool{true, false} {
+		config.Linux.SecurityContext.ReadonlyRootfs = readonly
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		require.NoError(t, err)
+		specCheck(t, testID, testPid, spec)
+		assert.Equal(t, readonly, spec.Root.Readonly)
+		tmpfs := map[string]int{}
+		for _, m := range spec.Mounts {
+			if m.Type == "tmpfs" {
+				tmpfs[m.Destination]++
+			}
+		}
+		if readonly {
+			assert.Equal(t, 1, tmpfs["/tmp"], "writable path should be mounted as tmpfs")
+		} else {
+			assert.Equal(t, 0, tmpfs["/tmp"], "writable path should not be mounted for writable rootfs")
+		}
+		assert.Equal(t, 1, tmpfs["/dev"], "already mounted path should not be mounted again")
+	}
+}
+
+func TestContainerSpecKeepIDUserNamespace(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	c := newTestCRIContainerdService()
+	for _, keepID := range []bool{true, false} {
+		c.config.KeepIDUserNamespace = keepID
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if keepID && os.Getuid() == 0 {
+			assert.Error(t, err, "should reject keep id user namespace as root")
+			continue
+		}
+		require.NoError(t, err)
+		specCheck(t, testID, testPid, spec)
+		if !keepID {
+			assert.NotContains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{Type: runtimespec.UserNamespace})
+			assert.Empty(t, spec.Linux.UIDMappings)
+			continue
+		}
+		assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{Type: runtimespec.UserNamespace})
+		assert.Equal(t, []runtimespec.LinuxIDMapping{{HostID: uint32(os.Getuid()), ContainerID: 0, Size: 1}},
+			spec.Linux.UIDMappings)
+		assert.Equal(t, []runtimespec.LinuxIDMapping{{HostID: uint32(os.Getgid()), ContainerID: 0, Size: 1}},
+			spec.Linux.GIDMappings)
+	}
+}
+
+func TestSetOCIKeepIDUserNamespace(t *testing.T) {
+	g := generate.New()
+	assert.Error(t, setOCIKeepIDUserNamespace(&g, 0, 0), "should reject host root")
+
+	g = generate.New()
+	require.NoError(t, setOCIKeepIDUserNamespace(&g, 1000, 100))
+	spec := g.Spec()
+	assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{Type: runtimespec.UserNamespace})
+	assert.Equal(t, []runtimespec.LinuxIDMapping{{HostID: 1000, ContainerID: 0, Size: 1}}, spec.Linux.UIDMappings)
+	assert.Equal(t, []runtimespec.LinuxIDMapping{{HostID: 100, ContainerID: 0, Size: 1}}, spec.Linux.GIDMappings)
+}
+
+func TestGetImageUser(t *testing.T) {
+	for desc, test := range map[string]struct {
+		securityContext *runtime.LinuxContainerSecurityContext
+		imageUser       string
+		expected        string
+	}{
+		"should use image user without security context": {
+			imageUser: "nobody:staff",
+			expected:  "nobody:staff",
+		},
+		"should use image user without user override": {
+			securityContext: &runtime.LinuxContainerSecurityContext{ReadonlyRootfs: true},
+			imageUser:       "1000",
+			expected:        "1000",
+		},
+		"should not use image user when uid is set": {
+			securityContext: &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 0}},
+			imageUser:       "nobody",
+		},
+		"should not use image user when username is set": {
+			securityContext: &runtime.LinuxContainerSecurityContext{RunAsUsername: "root"},
+			imageUser:       "nobody",
+		},
+		"should return empty without image user": {},
+	} {
+		t.Logf("TestCase %q", desc)
+		user := getImageUser(test.securityContext, &imagespec.ImageConfig{User: test.imageUser})
+		assert.Equal(t, test.expected, user)
+	}
+}
+
+// fakeTask is a containerd task only serving its status.
+type fakeTask struct {
+	containerd.Task
+	status containerd.ProcessStatus
+	err    error
+}
+
+func (f *fakeTask) Status(ctx context.Context) (containerd.Status, error) {
+	return containerd.Status{Status: f.status}, f.err
+}
+
+func TestEnsureSandboxRunning(t *testing.T) {
+	for desc, test := range map[string]struct {
+		task      *fakeTask
+		expectErr bool
+	}{
+		"should accept running sandbox": {
+			task: &fakeTask{status: containerd.Running},
+		},
+		"should reject stopped sandbox": {
+			task:      &fakeTask{status: containerd.Stopped},
+			expectErr: true,
+		},
+		"should reject paused sandbox": {
+			task:      &fakeTask{status: containerd.Paused},
+			expectErr: true,
+		},
+		"should return error when status is unavailable": {
+			task:      &fakeTask{err: errors.New("test error")},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := ensureSandboxRunning(context.Background(), "test-sandbox", test.task)
+		assert.Equal(t, test.expectErr, err != nil, err)
+	}
+}
+
+type fakeDeviceProvider struct {
+	allocation *DeviceAllocation
+	err        error
+	released   []string
+}
+
+func (f *fakeDeviceProvider) Allocate(containerID string, count int) (*DeviceAllocation, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	a := &DeviceAllocation{Envs: []string{fmt.Sprintf("FAKE_DEVICES=%d", count)}}
+	for i := 0; i < count; i++ {
+		a.Devices = append(a.Devices, f.allocation.Devices...)
+		a.Mounts = append(a.Mounts, f.allocation.Mounts...)
+	}
+	return a, nil
+}
+
+func (f *fakeDeviceProvider) Release(containerID string) error {
+	f.released = append(f.released, containerID)
+	return f.err
+}
+
+func TestAllocateDevices(t *testing.T) {
+	testDevice := &runtime.Device{ContainerPath: "/dev/fake0", HostPath: "/dev/fake0", Permissions: "rwm"}
+	testMount := &runtime.Mount{ContainerPath: "/usr/lib/fake", HostPath: "/usr/lib/fake", Readonly: true}
+	deviceProviders = map[string]DeviceProvider{
+		"example.com/fake": &fakeDeviceProvider{allocation: &DeviceAllocation{
+			Devices: []*runtime.Device{testDevice},
+			Mounts:  []*runtime.Mount{testMount},
+		}},
+		"example.com/broken": &fakeDeviceProvider{err: errors.New("test error")},
+	}
+	defer func() { deviceProviders = make(map[string]DeviceProvider) }()
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    *DeviceAllocation
+		expectErr   bool
+	}{
+		"should allocate nothing without resource annotation": {
+			expected: &DeviceAllocation{},
+		},
+		"should allocate devices from provider": {
+			annotations: map[string]string{deviceResourceAnnotationPrefix + "example.com/fake": "2"},
+			expected: &DeviceAllocation{
+				Devices: []*runtime.Device{testDevice, testDevice},
+				Mounts:  []*runtime.Mount{testMount, testMount},
+				Envs:    []string{"FAKE_DEVICES=2"},
+			},
+		},
+		"should skip zero count": {
+			annotations: map[string]string{deviceResourceAnnotationPrefix + "example.com/unknown": "0"},
+			expected:    &DeviceAllocation{},
+		},
+		"should return error for invalid count": {
+			annotations: map[string]string{deviceResourceAnnotationPrefix + "example.com/fake": "-1"},
+			expectErr:   true,
+		},
+		"should return error for unknown resource": {
+			annotations: map[string]string{deviceResourceAnnotationPrefix + "example.com/unknown": "1"},
+			expectErr:   true,
+		},
+		"should return error when provider fails": {
+			annotations: map[string]string{deviceResourceAnnotationPrefix + "example.com/broken": "1"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		allocation, err := allocateDevices("test-id", test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, allocation)
+	}
+}
+
+func TestReleaseDevices(t *testing.T) {
+	fake := &fakeDeviceProvider{}
+	broken := &fakeDeviceProvider{err: errors.New("test error")}
+	unused := &fakeDeviceProvider{}
+	deviceProviders = map[string]DeviceProvider{
+		"example.com/fake":   fake,
+		"example.com/broken": broken,
+		"example.com/unused": unused,
+	}
+	defer func() { deviceProviders = make(map[string]DeviceProvider) }()
+	releaseDevices("test-id", map[string]string{
+		deviceResourceAnnotationPrefix + "example.com/broken":  "1",
+		deviceResourceAnnotationPrefix + "example.com/fake":    "2",
+		deviceResourceAnnotationPrefix + "example.com/unknown": "1",
+		"other": "annotation",
+	})
+	assert.Equal(t, []string{"test-id"}, fake.released, "should release requested resource")
+	assert.Equal(t, []string{"test-id"}, broken.released, "should release requested resource")
+	assert.Empty(t, unused.released, "should not release resource not requested")
+}
+
+func TestSetOCIHooks(t *testing.T) {
+	allowed := []string{"/usr/bin/node-hook", "/usr/bin/container-hook"}
+	timeout := 5
+	for desc, test := range map[string]struct {
+		defaultHooks   string
+		containerHooks string
+		expected       *runtimespec.Hooks
+		expectErr      bool
+	}{
+		"should not set hooks without hooks": {},
+		"should set hooks from node config and annotation in order": {
+			defaultHooks:   `{"prestart":[{"path":"/usr/bin/node-hook","args":["node-hook","setup"]}]}`,
+			containerHooks: `{"prestart":[{"path":"/usr/bin/container-hook","env":["A=B"],"timeout":5}],"poststop":[{"path":"/usr/bin/container-hook"}]}`,
+			expected: &runtimespec.Hooks{
+				Prestart: []runtimespec.Hook{
+					{Path: "/usr/bin/node-hook", Args: []string{"node-hook", "setup"}},
+					{Path: "/usr/bin/container-hook", Env: []string{"A=B"}, Timeout: &timeout},
+				},
+				Poststop: []runtimespec.Hook{{Path: "/usr/bin/container-hook"}},
+			},
+		},
+		"should return error for hook not allowed": {
+			containerHooks: `{"poststart":[{"path":"/bin/sh"}]}`,
+			expectErr:      true,
+		},
+		"should return error for relative hook path": {
+			containerHooks: `{"prestart":[{"path":"node-hook"}]}`,
+			expectErr:      true,
+		},
+		"should return error for invalid timeout": {
+			containerHooks: `{"prestart":[{"path":"/usr/bin/container-hook","timeout":0}]}`,
+			expectErr:      true,
+		},
+		"should return error for malformed hooks": {
+			containerHooks: `{"prestart":`,
+			expectErr:      true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		err := setOCIHooks(&g, test.defaultHooks, test.containerHooks, allowed)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, g.Spec().Hooks)
+	}
+}
+
+func TestContainerSpecInit(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		initPath    string
+		expectInit  bool
+		expectErr   bool
+	}{
+		"should not run init by default": {
+			initPath: "/usr/bin/tini",
+		},
+		"should run init when requested": {
+			annotations: map[string]string{initAnnotation: "true"},
+			initPath:    "/usr/bin/tini",
+			expectInit:  true,
+		},
+		"should not run init when disabled": {
+			annotations: map[string]string{initAnnotation: "false"},
+			initPath:    "/usr/bin/tini",
+		},
+		"should return error when init is not configured": {
+			annotations: map[string]string{initAnnotation: "true"},
+			expectErr:   true,
+		},
+		"should return error for invalid annotation": {
+			annotations: map[string]string{initAnnotation: "invalid"},
+			initPath:    "/usr/bin/tini",
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Annotations = test.annotations
+		c := newTestCRIContainerdService()
+		c.config.InitPath = test.initPath
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		args := append(append([]string{}, config.GetCommand()...), config.GetArgs()...)
+		if test.expectInit {
+			assert.Equal(t, append([]string{containerInitPath, "--"}, args...), spec.Process.Args)
+			checkMount(t, spec.Mounts, test.initPath, containerInitPath, "bind", []string{"ro"}, nil)
+		} else {
+			assert.Equal(t, args, spec.Process.Args)
+		}
+	}
+}
+
+func TestContainerSpecImageLabelAnnotations(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	imageConfig.Labels = map[string]string{
+		"org.opencontainers.image.source":   "https://example.com/repo",
+		"org.opencontainers.image.revision": "abc",
+		"com.example.internal":              "secret",
+	}
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, spec.Annotations, "image labels should not be propagated by default")
+
+	c.config.ImageLabelAnnotationPrefixes = []string{"org.opencontainers.image."}
+	spec, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.source":   "https://example.com/repo",
+		"org.opencontainers.image.revision": "abc",
+	}, spec.Annotations)
+}
+
+type fakeCDIResolver struct {
+	resolved []string
+	edits    *CDIEdits
+}
+
+func (f *fakeCDIResolver) Resolve(devices []string) (*CDIEdits, error) {
+	f.resolved = append(f.resolved, devices...)
+	return f.edits, nil
+}
+
+func TestResolveCDIDevices(t *testing.T) {
+	testDevice := &runtime.Device{ContainerPath: "/dev/test", HostPath: "/dev/test", Permissions: "rwm"}
+	for desc, test := range map[string]struct {
+		annotations     map[string]string
+		devices         []*runtime.Device
+		noResolver      bool
+		expectedDevices []*runtime.Device
+		expectedNames   []string
+		expectErr       bool
+	}{
+		"should no-op without CDI devices": {
+			devices:         []*runtime.Device{testDevice},
+			expectedDevices: []*runtime.Device{testDevice},
+		},
+		"should not require resolver without CDI devices": {
+			noResolver: true,
+		},
+		"should resolve CDI devices from annotation and CRI devices": {
+			annotations:     map[string]string{cdiDevicesAnnotation: "vendor.com/gpu=0,vendor.com/gpu=1"},
+			devices:         []*runtime.Device{testDevice, {HostPath: "vendor.com/nic=eth1"}},
+			expectedDevices: []*runtime.Device{testDevice},
+			expectedNames:   []string{"vendor.com/gpu=0", "vendor.com/gpu=1", "vendor.com/nic=eth1"},
+		},
+		"should return error for invalid CDI device name": {
+			annotations: map[string]string{cdiDevicesAnnotation: "gpu0"},
+			expectErr:   true,
+		},
+		"should return error without resolver": {
+			annotations: map[string]string{cdiDevicesAnnotation: "vendor.com/gpu=0"},
+			noResolver:  true,
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		resolver := &fakeCDIResolver{edits: &CDIEdits{}}
+		cdiResolver = resolver
+		if test.noResolver {
+			cdiResolver = nil
+		}
+		config := &runtime.ContainerConfig{Annotations: test.annotations, Devices: test.devices}
+		devs, edits, err := resolveCDIDevices(config)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedDevices, devs)
+		assert.Equal(t, test.expectedNames, resolver.resolved)
+		assert.Equal(t, len(test.expectedNames) != 0, edits != nil)
+	}
+	cdiResolver = nil
+}
+
+func TestContainerSpecCDIEdits(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	cdiResolver = &fakeCDIResolver{edits: &CDIEdits{
+		DeviceAllocation: DeviceAllocation{Envs: []string{"VENDOR_VISIBLE_DEVICES=0"}},
+		Hooks:            &runtimespec.Hooks{Prestart: []runtimespec.Hook{{Path: "/usr/bin/vendor-hook"}}},
+	}}
+	defer func() { cdiResolver = nil }()
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Annotations = map[string]string{cdiDevicesAnnotation: "vendor.com/gpu=0"}
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Contains(t, spec.Process.Env, "VENDOR_VISIBLE_DEVICES=0")
+	require.NotNil(t, spec.Hooks)
+	assert.Equal(t, []runtimespec.Hook{{Path: "/usr/bin/vendor-hook"}}, spec.Hooks.Prestart)
+}
+
+func TestContainerSpecRlimits(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	getRlimit := func(spec *runtimespec.Spec, typ string) *runtimespec.POSIXRlimit {
+		for _, r := range spec.Process.Rlimits {
+			if r.Type == typ {
+				return &r
+			}
+		}
+		return nil
+	}
+	for desc, test := range map[string]struct {
+		defaults         []string
+		imageRlimits     string
+		containerRlimits string
+		expected         map[string]runtimespec.POSIXRlimit
+		expectErr        bool
+	}{
+		"should apply node defaults": {
+			defaults: []string{"nofile=1048576", "nproc=1024:2048"},
+			expected: map[string]runtimespec.POSIXRlimit{
+				"RLIMIT_NOFILE": {Type: "RLIMIT_NOFILE", Soft: 1048576, Hard: 1048576},
+				"RLIMIT_NPROC":  {Type: "RLIMIT_NPROC", Soft: 1024, Hard: 2048},
+			},
+		},
+		"image rlimits should override node defaults": {
+			defaults:     []string{"nofile=1048576", "nproc=1024"},
+			imageRlimits: "nofile=4096",
+			expected: map[string]runtimespec.POSIXRlimit{
+				"RLIMIT_NOFILE": {Type: "RLIMIT_NOFILE", Soft: 4096, Hard: 4096},
+				"RLIMIT_NPROC":  {Type: "RLIMIT_NPROC", Soft: 1024, Hard: 1024},
+			},
+		},
+		"container rlimits should override image rlimits and node defaults": {
+			defaults:         []string{"nofile=1048576", "nproc=1024"},
+			imageRlimits:     "nofile=4096,core=0",
+			containerRlimits: "nofile=2048:8192",
+			expected: map[string]runtimespec.POSIXRlimit{
+				"RLIMIT_NOFILE": {Type: "RLIMIT_NOFILE", Soft: 2048, Hard: 8192},
+				"RLIMIT_NPROC":  {Type: "RLIMIT_NPROC", Soft: 1024, Hard: 1024},
+				"RLIMIT_CORE":   {Type: "RLIMIT_CORE", Soft: 0, Hard: 0},
+			},
+		},
+		"should return error for unknown rlimit": {
+			containerRlimits: "unknown=1",
+			expectErr:        true,
+		},
+		"should return error for invalid limit": {
+			containerRlimits: "nofile=abc",
+			expectErr:        true,
+		},
+		"should return error for soft limit exceeding hard limit": {
+			containerRlimits: "nofile=2048:1024",
+			expectErr:        true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		imageConfig.Labels = map[string]string{rlimitsAnnotation: test.imageRlimits}
+		config.Annotations = map[string]string{rlimitsAnnotation: test.containerRlimits}
+		c := newTestCRIContainerdService()
+		c.config.DefaultRlimits = test.defaults
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		for typ, expected := range test.expected {
+			rlimit := getRlimit(spec, typ)
+			require.NotNil(t, rlimit, "rlimit %q should be set", typ)
+			assert.Equal(t, expected, *rlimit)
+		}
+	}
+}
+
+func TestSetOCIProcMountOptions(t *testing.T) {
+	for desc, test := range map[string]struct {
+		options     []string
+		v2Supported bool
+		expected    []string
+		expectErr   bool
+	}{
+		"should add supported options": {
+			options:     []string{"hidepid=invisible", "subset=pid"},
+			v2Supported: true,
+			expected:    []string{"hidepid=invisible", "subset=pid"},
+		},
+		"should drop options not supported by the kernel": {
+			options:  []string{"hidepid=2", "subset=pid"},
+			expected: []string{"hidepid=2"},
+		},
+		"should return error for unknown option": {
+			options:   []string{"gid=0"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec, err := defaultRuntimeSpec(k8sContainerdNamespace, "test-id", false)
+		require.NoError(t, err)
+		g := generate.NewFromSpec(spec)
+		var defaultOptions []string
+		for _, m := range spec.Mounts {
+			if m.Destination == "/proc" {
+				defaultOptions = append([]string{}, m.Options...)
+			}
+		}
+		err = setOCIProcMountOptions(&g, test.options, test.v2Supported)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		for _, m := range g.Spec().Mounts {
+			if m.Destination == "/proc" {
+				assert.Equal(t, append(defaultOptions, test.expected...), m.Options)
+			}
+		}
+	}
+}
+
+func TestAddOCIPodEnvs(t *testing.T) {
+	for desc, test := range map[string]struct {
+		envs     []string
+		hostname string
+		ip       string
+		expected []string
+	}{
+		"should add pod ip and hostname": {
+			envs:     []string{"PATH=/bin"},
+			hostname: "test-hostname",
+			ip:       "10.0.0.2",
+			expected: []string{"PATH=/bin", "POD_IP=10.0.0.2", "HOSTNAME=test-hostname"},
+		},
+		"should not override envs already set": {
+			envs:     []string{"POD_IP=1.1.1.1", "HOSTNAME=custom"},
+			hostname: "test-hostname",
+			ip:       "10.0.0.2",
+			expected: []string{"POD_IP=1.1.1.1", "HOSTNAME=custom"},
+		},
+		"should skip empty values": {
+			envs:     []string{"PATH=/bin"},
+			expected: []string{"PATH=/bin"},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{
+			Hostname: test.hostname,
+			Process:  &runtimespec.Process{Env: test.envs},
+		}
+		addOCIPodEnvs(spec, test.ip)
+		assert.Equal(t, test.expected, spec.Process.Env)
+	}
+}
+
+func TestContainerSpecHostname(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for desc, test := range map[string]struct {
+		disabled        bool
+		sandboxHostname string
+		annotations     map[string]string
+		hostNetwork     bool
+		expected        string
+		privateUTS      bool
+		expectErr       bool
+	}{
+		"should not set hostname by default": {
+			disabled: true,
+		},
+		"should set sandbox hostname": {
+			expected: "test-hostname",
+		},
+		"should allow hostname override same as sandbox hostname": {
+			annotations: map[string]string{hostnameAnnotation: "test-hostname"},
+			expected:    "test-hostname",
+		},
+		"should set hostname override in a private UTS namespace": {
+			annotations: map[string]string{hostnameAnnotation: "test-container-hostname"},
+			expected:    "test-container-hostname",
+			privateUTS:  true,
+		},
+		"should not set hostname for host network": {
+			annotations: map[string]string{hostnameAnnotation: "test-container-hostname"},
+			hostNetwork: true,
+		},
+		"should return error for too long hostname": {
+			sandboxHostname: strings.Repeat("a", maxHostnameLength+1),
+			expectErr:       true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		c := newTestCRIContainerdService()
+		c.config.SetContainerHostname = !test.disabled
+		sandboxConfig.Hostname = "test-hostname"
+		if test.sandboxHostname != "" {
+			sandboxConfig.Hostname = test.sandboxHostname
+		}
+		config.Annotations = test.annotations
+		config.Linux.SecurityContext.NamespaceOptions = &runtime.NamespaceOption{HostNetwork: test.hostNetwork}
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Hostname)
+		utsNamespace := runtimespec.LinuxNamespace{Type: runtimespec.UTSNamespace, Path: getUTSNamespace(testPid)}
+		if test.privateUTS {
+			utsNamespace.Path = ""
+		}
+		assert.Contains(t, spec.Linux.Namespaces, utsNamespace)
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	config := &runtime.ContainerConfig{
+		Mounts: []*runtime.Mount{
+			{
+				ContainerPath: "/test-volume-1",
+				HostPath:      "/test-host-path-1",
+			},
+			{
+				ContainerPath: "/test-container-path",
+				HostPath:      "/test-host-path-2",
+				Propagation:   runtime.MountPropagation(100),
+			},
+		},
+	}
+	imageConfig := &imagespec.ImageConfig{
+		Volumes: map[string]struct{}{
+			"/test-volume-1": {},
+			"/test-volume-2": {},
+		},
+	}
+	assert.Equal(t, []string{
+		`image volume "/test-volume-1" is skipped because it is overridden by a CRI mount`,
+		`unknown propagation mode 100 for mount "/test-container-path", rprivate is used`,
+	}, configWarnings(config, imageConfig))
+	assert.Empty(t, configWarnings(&runtime.ContainerConfig{}, &imagespec.ImageConfig{}))
+}
+
+func TestValidateSpec(t *testing.T) {
+	spec, err := defaultRuntimeSpec(k8sContainerdNamespace, "test-id", false)
+	require.NoError(t, err)
+	spec.Version = "invalid-version"
+	assert.Error(t, validateSpec(spec), "should reject invalid spec version")
+}
+
+func TestEffectiveEnv(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Tty = true
+	c := newTestCRIContainerdService()
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+
+	envs, err := EffectiveEnv(config, imageConfig)
+	require.NoError(t, err)
+	assert.Equal(t, spec.Process.Env, envs)
+
+	imageConfig.Env = []string{"invalid-env"}
+	_, err = EffectiveEnv(config, imageConfig)
+	assert.Error(t, err)
+}
+
+func TestRedactSpec(t *testing.T) {
+	spec := &runtimespec.Spec{
+		Process: &runtimespec.Process{
+			Env: []string{"PATH=/bin", "DB_PASSWORD=secret", "API_TOKEN=token", "EMPTY"},
+		},
+	}
+	redacted := redactSpec(spec, []string{"*_PASSWORD", "API_TOKEN", "EMPTY"})
+	assert.Equal(t, []string{"PATH=/bin", "DB_PASSWORD=<redacted>", "API_TOKEN=<redacted>", "EMPTY=<redacted>"},
+		redacted.Process.Env)
+	assert.Equal(t, []string{"PATH=/bin", "DB_PASSWORD=secret", "API_TOKEN=token", "EMPTY"},
+		spec.Process.Env, "original spec should not be changed")
+	assert.Equal(t, spec, redactSpec(spec, nil))
+}
+
+func TestPrivilegedContainerSelinuxLabel(t *testing.T) {
+	if !selinux.GetEnabled() {
+		return
+	}
+	testID := "test-id"
+	testPid := uint32(1234)
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Linux.SecurityContext.Privileged = true
+	sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: true}
+	config.Linux.SecurityContext.SelinuxOptions = &runtime.SELinuxOption{
+		User:  "user_u",
+		Role:  "user_r",
+		Type:  "user_t",
+		Level: "s0:c1,c2",
+	}
+	for desc, test := range map[string]struct {
+		keepLabels bool
+		expectSet  bool
+	}{
+		"should not set selinux labels for privileged container by default": {},
+		"should keep selinux labels for privileged container if configured": {
+			keepLabels: true,
+			expectSet:  true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.KeepPrivilegedSelinuxLabels = test.keepLabels
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
 		require.NoError(t, err)
-		specCheck(t, testID, testPid, spec)
-		t.Log(spec.Process.Capabilities.Bounding)
-		for _, include := range test.includes {
-			assert.Contains(t, spec.Process.Capabilities.Bounding, include)
-			assert.Contains(t, spec.Process.Capabilities.Effective, include)
-			assert.Contains(t, spec.Process.Capabilities.Inheritable, include)
-			assert.Contains(t, spec.Process.Capabilities.Permitted, include)
-		}
-		for _, exclude := range test.excludes {
-			assert.NotContains(t, spec.Process.Capabilities.Bounding, exclude)
-			assert.NotContains(t, spec.Process.Capabilities.Effective, exclude)
-			assert.NotContains(t, spec.Process.Capabilities.Inheritable, exclude)
-			assert.NotContains(t, spec.Process.Capabilities.Permitted, exclude)
+		if test.expectSet {
+			assert.Equal(t, "user_u:user_r:user_t:s0:c1,c2", spec.Process.SelinuxLabel)
+			assert.NotEmpty(t, spec.Linux.MountLabel)
+		} else {
+			assert.Empty(t, spec.Process.SelinuxLabel)
+			assert.Empty(t, spec.Linux.MountLabel)
 		}
 	}
 }
 
-func TestContainerSpecTty(t *testing.T) {
+func TestPrivilegedContainerInSandbox(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
-	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
-	c := newTestCRIContainerdService()
-	for _, tty := range []bool{true, false} {
-		config.Tty = tty
-		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
-		require.NoError(t, err)
-		specCheck(t, testID, testPid, spec)
-		assert.Equal(t, tty, spec.Process.Terminal)
-		if tty {
-			assert.Contains(t, spec.Process.Env, "TERM=xterm")
+	for desc, test := range map[string]struct {
+		privileged        bool
+		sandboxPrivileged bool
+		expectErr         bool
+	}{
+		"should allow non-privileged container in non-privileged sandbox": {},
+		"should allow non-privileged container in privileged sandbox": {
+			sandboxPrivileged: true,
+		},
+		"should not allow privileged container in non-privileged sandbox": {
+			privileged: true,
+			expectErr:  true,
+		},
+		"should allow privileged container in privileged sandbox": {
+			privileged:        true,
+			sandboxPrivileged: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Linux.SecurityContext.Privileged = test.privileged
+		sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{
+			Privileged: test.sandboxPrivileged,
+		}
+		c := newTestCRIContainerdService()
+		_, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
 		} else {
-			assert.NotContains(t, spec.Process.Env, "TERM=xterm")
+			assert.NoError(t, err)
 		}
 	}
 }
 
-func TestContainerSpecReadonlyRootfs(t *testing.T) {
+func TestValidateCapabilities(t *testing.T) {
+	for desc, test := range map[string]struct {
+		capabilities []string
+		expectErr    string
+	}{
+		"should pass known capabilities": {
+			capabilities: []string{"NET_ADMIN", "sys_admin", "ALL"},
+		},
+		"should suggest the closest capability for a typo": {
+			capabilities: []string{"CHOWN", "NET_ADMN"},
+			expectErr:    `unknown capability "NET_ADMN", did you mean "NET_ADMIN"?`,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateCapabilities(test.capabilities)
+		if test.expectErr != "" {
+			assert.EqualError(t, err, test.expectErr)
+			continue
+		}
+		assert.NoError(t, err)
+	}
+}
+
+func TestPrivilegedContainerWithoutHostDevices(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
-	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
+	config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+	config.Linux.SecurityContext.Privileged = true
+	sandboxConfig.Linux.SecurityContext = &runtime.LinuxSandboxSecurityContext{Privileged: true}
+	config.Annotations[privilegedWithoutHostDevicesAnnotation] = "true"
 	c := newTestCRIContainerdService()
-	for _, readonly := range []bool{true, false} {
-		config.Linux.SecurityContext.ReadonlyRootfs = readonly
-		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
-		require.NoError(t, err)
-		specCheck(t, testID, testPid, spec)
-		assert.Equal(t, readonly, spec.Root.Readonly)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	require.NoError(t, err)
+	assert.Contains(t, spec.Process.Capabilities.Bounding, "CAP_SYS_ADMIN")
+	assert.Empty(t, spec.Linux.MaskedPaths)
+	assert.Empty(t, spec.Linux.Devices)
+	for _, d := range spec.Linux.Resources.Devices {
+		assert.False(t, d.Allow && d.Type == "" && d.Major == nil && d.Minor == nil,
+			"all devices should not be allowed")
 	}
+
+	t.Logf("should return error for invalid annotation")
+	config.Annotations[privilegedWithoutHostDevicesAnnotation] = "invalid"
+	_, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+	assert.Error(t, err)
 }
 
 func TestContainerSpecWithExtraMounts(t *testing.T) {
@@ -289,22 +1340,22 @@ func TestContainerSpecWithExtraMounts(t *testing.T) {
 	config, sandboxConfig, imageConfig, specCheck := getCreateContainerTestData()
 	c := newTestCRIContainerdService()
 	mountInConfig := &runtime.Mount{
-		ContainerPath: "test-container-path",
+		ContainerPath: "/test-container-path",
 		HostPath:      "test-host-path",
 		Readonly:      false,
 	}
 	config.Mounts = append(config.Mounts, mountInConfig)
 	extraMount := &runtime.Mount{
-		ContainerPath: "test-container-path",
+		ContainerPath: "/test-container-path",
 		HostPath:      "test-host-path-extra",
 		Readonly:      true,
 	}
-	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, []*runtime.Mount{extraMount})
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, []*runtime.Mount{extraMount}, nil)
 	require.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 	var mounts []runtimespec.Mount
 	for _, m := range spec.Mounts {
-		if m.Destination == "test-container-path" {
+		if m.Destination == "/test-container-path" {
 			mounts = append(mounts, m)
 		}
 	}
@@ -415,7 +1466,7 @@ func TestGenerateVolumeMounts(t *testing.T) {
 			Volumes: test.imageVolumes,
 		}
 		c := newTestCRIContainerdService()
-		got := c.generateVolumeMounts(testContainerRootDir, test.criMounts, config)
+		got := c.generateVolumeMounts(testContainerRootDir, "", test.criMounts, config)
 		assert.Len(t, got, len(test.expectedMountDest))
 		for _, dest := range test.expectedMountDest {
 			found := false
@@ -425,6 +1476,7 @@ func TestGenerateVolumeMounts(t *testing.T) {
 					assert.Equal(t,
 						filepath.Dir(m.HostPath),
 						filepath.Join(testContainerRootDir, "volumes"))
+					assert.Equal(t, selinux.GetEnabled(), m.SelinuxRelabel)
 					break
 				}
 			}
@@ -433,13 +1485,193 @@ func TestGenerateVolumeMounts(t *testing.T) {
 	}
 }
 
+func TestAcquireCreateSlot(t *testing.T) {
+	c := newTestCRIContainerdService()
+	t.Logf("should not limit without create limiter")
+	release, err := c.acquireCreateSlot(context.Background())
+	require.NoError(t, err)
+	release()
+
+	c.createLimiter = make(chan struct{}, 1)
+	release, err = c.acquireCreateSlot(context.Background())
+	require.NoError(t, err)
+
+	t.Logf("should wait for a free slot until ctx is done")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.acquireCreateSlot(ctx)
+	assert.Error(t, err)
+
+	t.Logf("should acquire the slot after it is released")
+	release()
+	release, err = c.acquireCreateSlot(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestEnsureNoStaleContainerRootDir(t *testing.T) {
+	testID := "test-id"
+	testRootDir := "test-root-dir"
+	for desc, test := range map[string]struct {
+		statErr      error
+		inStore      bool
+		expectRemove bool
+		expectErr    bool
+	}{
+		"should do nothing if the directory doesn't exist": {
+			statErr: os.ErrNotExist,
+		},
+		"should remove stale directory": {
+			expectRemove: true,
+		},
+		"should return error if the directory belongs to a known container": {
+			inStore:   true,
+			expectErr: true,
+		},
+		"should return error if stat fails": {
+			statErr:   errors.New("random error"),
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeOS.StatFn = func(string) (os.FileInfo, error) {
+			return nil, test.statErr
+		}
+		removed := false
+		fakeOS.RemoveAllFn = func(path string) error {
+			assert.Equal(t, testRootDir, path)
+			removed = true
+			return nil
+		}
+		if test.inStore {
+			container, err := containerstore.NewContainer(containerstore.Metadata{ID: testID})
+			require.NoError(t, err)
+			require.NoError(t, c.containerStore.Add(container))
+		}
+		err := c.ensureNoStaleContainerRootDir(testID, testRootDir)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, test.expectRemove, removed)
+	}
+}
+
+func TestMountConflictWarnings(t *testing.T) {
+	for desc, test := range map[string]struct {
+		sources   []mountSource
+		expected  []string
+		expectErr bool
+	}{
+		"should not warn without conflict": {
+			sources: []mountSource{
+				{name: "generated mounts", mounts: []*runtime.Mount{{ContainerPath: "/etc/hosts"}}},
+				{name: "container config", mounts: []*runtime.Mount{{ContainerPath: "/data"}}},
+			},
+		},
+		"should warn when image volume overrides generated mount": {
+			sources: []mountSource{
+				{name: "generated mounts", mounts: []*runtime.Mount{{ContainerPath: "/etc/hosts"}}},
+				{name: "image volumes", mounts: []*runtime.Mount{{ContainerPath: "/etc/hosts"}}},
+			},
+			expected: []string{
+				`mount "/etc/hosts" from generated mounts is overridden by mount from image volumes`,
+			},
+		},
+		"should warn when later source overrides mount": {
+			sources: []mountSource{
+				{name: "generated mounts", mounts: []*runtime.Mount{{ContainerPath: "/etc/hosts"}}},
+				{name: "device provider", mounts: []*runtime.Mount{{ContainerPath: "/usr/lib/driver"}}},
+				{name: "container config", mounts: []*runtime.Mount{{ContainerPath: "/etc/hosts/"}, {ContainerPath: "/usr/lib/driver"}}},
+			},
+			expected: []string{
+				`mount "/etc/hosts" from generated mounts is overridden by mount from container config`,
+				`mount "/usr/lib/driver" from device provider is overridden by mount from container config`,
+			},
+		},
+		"should warn for duplicate mounts from the same non-config source": {
+			sources: []mountSource{
+				{name: "device provider", mounts: []*runtime.Mount{{ContainerPath: "/dev/shm"}, {ContainerPath: "/dev/shm"}}},
+			},
+			expected: []string{
+				`mount "/dev/shm" from device provider is specified multiple times, the last one applies`,
+			},
+		},
+		"should return error for duplicate mounts in container config": {
+			sources: []mountSource{
+				{name: "container config", mounts: []*runtime.Mount{{ContainerPath: "/data"}, {ContainerPath: "/data"}}},
+			},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		warnings, err := mountConflictWarnings(test.sources)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, warnings)
+	}
+}
+
+func TestGeneratePersistentVolumeMounts(t *testing.T) {
+	testPersistentVolumeDir := "test-sandbox-root/volumes/test-name"
+	config := &imagespec.ImageConfig{
+		Volumes: map[string]struct{}{
+			"/test-volume-1": {},
+			"/test-volume-2": {},
+		},
+	}
+	c := newTestCRIContainerdService()
+	getHostPaths := func(containerRootDir string) map[string]string {
+		paths := make(map[string]string)
+		for _, m := range c.generateVolumeMounts(containerRootDir, testPersistentVolumeDir, nil, config) {
+			assert.Equal(t, testPersistentVolumeDir, filepath.Dir(m.HostPath))
+			paths[m.ContainerPath] = m.HostPath
+		}
+		return paths
+	}
+	first := getHostPaths("test-container-root-1")
+	assert.Len(t, first, 2)
+	assert.NotEqual(t, first["/test-volume-1"], first["/test-volume-2"])
+	assert.Equal(t, first, getHostPaths("test-container-root-2"),
+		"host paths should be stable across container recreation")
+}
+
 func TestGenerateContainerMounts(t *testing.T) {
 	testSandboxRootDir := "test-sandbox-root"
 	for desc, test := range map[string]struct {
 		criMounts       []*runtime.Mount
+		envs            []*runtime.KeyValue
+		annotations     map[string]string
 		securityContext *runtime.LinuxContainerSecurityContext
 		expectedMounts  []*runtime.Mount
 	}{
+		"should skip /dev/shm mount with annotation": {
+			annotations:     map[string]string{skipDevShmAnnotation: "true"},
+			securityContext: &runtime.LinuxContainerSecurityContext{},
+			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hosts",
+					HostPath:      testSandboxRootDir + "/hosts",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: resolvConfPath,
+					HostPath:      testSandboxRootDir + "/resolv.conf",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: "/etc/localtime",
+					HostPath:      "/etc/localtime",
+					Readonly:      true,
+				},
+			},
+		},
 		"should setup ro mount when rootfs is read-only": {
 			securityContext: &runtime.LinuxContainerSecurityContext{
 				ReadonlyRootfs: true,
@@ -460,6 +1692,11 @@ func TestGenerateContainerMounts(t *testing.T) {
 					HostPath:      testSandboxRootDir + "/shm",
 					Readonly:      false,
 				},
+				{
+					ContainerPath: "/etc/localtime",
+					HostPath:      "/etc/localtime",
+					Readonly:      true,
+				},
 			},
 		},
 		"should setup rw mount when rootfs is read-write": {
@@ -480,6 +1717,11 @@ func TestGenerateContainerMounts(t *testing.T) {
 					HostPath:      testSandboxRootDir + "/shm",
 					Readonly:      false,
 				},
+				{
+					ContainerPath: "/etc/localtime",
+					HostPath:      "/etc/localtime",
+					Readonly:      true,
+				},
 			},
 		},
 		"should use host /dev/shm when host ipc is set": {
@@ -502,6 +1744,32 @@ func TestGenerateContainerMounts(t *testing.T) {
 					HostPath:      "/dev/shm",
 					Readonly:      false,
 				},
+				{
+					ContainerPath: "/etc/localtime",
+					HostPath:      "/etc/localtime",
+					Readonly:      true,
+				},
+			},
+		},
+		"should not mount host localtime when TZ is set": {
+			envs:            []*runtime.KeyValue{{Key: "TZ", Value: "UTC"}},
+			securityContext: &runtime.LinuxContainerSecurityContext{},
+			expectedMounts: []*runtime.Mount{
+				{
+					ContainerPath: "/etc/hosts",
+					HostPath:      testSandboxRootDir + "/hosts",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: resolvConfPath,
+					HostPath:      testSandboxRootDir + "/resolv.conf",
+					Readonly:      false,
+				},
+				{
+					ContainerPath: "/dev/shm",
+					HostPath:      testSandboxRootDir + "/shm",
+					Readonly:      false,
+				},
 			},
 		},
 		"should skip contaner mounts if already mounted by CRI": {
@@ -518,24 +1786,217 @@ func TestGenerateContainerMounts(t *testing.T) {
 					ContainerPath: "/dev/shm",
 					HostPath:      "test-dev-shm",
 				},
+				{
+					ContainerPath: "/etc/localtime",
+					HostPath:      "test-localtime",
+				},
 			},
 			securityContext: &runtime.LinuxContainerSecurityContext{},
 			expectedMounts:  nil,
 		},
 	} {
-		config := &runtime.ContainerConfig{
-			Metadata: &runtime.ContainerMetadata{
-				Name:    "test-name",
-				Attempt: 1,
-			},
-			Mounts: test.criMounts,
-			Linux: &runtime.LinuxContainerConfig{
-				SecurityContext: test.securityContext,
-			},
-		}
+		config := &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{
+				Name:    "test-name",
+				Attempt: 1,
+			},
+			Mounts:      test.criMounts,
+			Envs:        test.envs,
+			Annotations: test.annotations,
+			Linux: &runtime.LinuxContainerConfig{
+				SecurityContext: test.securityContext,
+			},
+		}
+		c := newTestCRIContainerdService()
+		mounts := c.generateContainerMounts(testSandboxRootDir, config, &imagespec.ImageConfig{})
+		assert.Equal(t, test.expectedMounts, mounts, desc)
+	}
+}
+
+func TestIsDeviceAllowed(t *testing.T) {
+	for desc, test := range map[string]struct {
+		path      string
+		allowed   []string
+		expected  bool
+		expectErr bool
+	}{
+		"should allow all devices if allowlist is empty": {
+			path:     "/dev/mem",
+			expected: true,
+		},
+		"should allow device matching a glob": {
+			path:     "/dev/nvidia0",
+			allowed:  []string{"/dev/fuse", "/dev/nvidia*"},
+			expected: true,
+		},
+		"should reject device not matching any glob": {
+			path:     "/dev/mem",
+			allowed:  []string{"/dev/fuse", "/dev/nvidia*"},
+			expected: false,
+		},
+		"should return error for invalid glob": {
+			path:      "/dev/fuse",
+			allowed:   []string{"/dev/["},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		allowed, err := isDeviceAllowed(test.path, test.allowed)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, allowed)
+	}
+}
+
+func TestRestrictedMountOptions(t *testing.T) {
+	for desc, test := range map[string]struct {
+		restrict        bool
+		noExec          bool
+		extraOptions    []string
+		expectedOptions []string
+	}{
+		"should not add options by default": {
+			expectedOptions: []string{"rbind", "rprivate", "rw"},
+		},
+		"should add nosuid and nodev when mounts are restricted": {
+			restrict:        true,
+			expectedOptions: []string{"rbind", "rprivate", "rw", "nosuid", "nodev"},
+		},
+		"should add noexec when configured": {
+			noExec:          true,
+			expectedOptions: []string{"rbind", "rprivate", "rw", "noexec"},
+		},
+		"should add all restricted options": {
+			restrict:        true,
+			noExec:          true,
+			expectedOptions: []string{"rbind", "rprivate", "rw", "nosuid", "nodev", "noexec"},
+		},
+		"should add extra options after restricted options": {
+			restrict:        true,
+			extraOptions:    []string{"noatime"},
+			expectedOptions: []string{"rbind", "rprivate", "rw", "nosuid", "nodev", "noatime"},
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		c := newTestCRIContainerdService()
+		c.config.RestrictMounts = test.restrict
+		c.config.NoExecMounts = test.noExec
+		err := c.addOCIBindMounts(&g, []*runtime.Mount{{
+			ContainerPath: "/test-container-path",
+			HostPath:      "/test-host-path",
+			Propagation:   runtime.MountPropagation_PROPAGATION_PRIVATE,
+		}}, "", map[string]mountOptions{
+			"/test-container-path": {Options: test.extraOptions},
+		}, cgroupMountReadOnly)
+		require.NoError(t, err)
+		var found bool
+		for _, m := range g.Spec().Mounts {
+			if m.Destination == "/test-container-path" {
+				found = true
+				assert.Equal(t, test.expectedOptions, m.Options)
+			}
+		}
+		assert.True(t, found)
+	}
+}
+
+func TestResolveMountSource(t *testing.T) {
+	tokens := map[string]string{
+		"hostrun":      "/run",
+		"podresources": "/var/lib/kubelet/pod-resources",
+	}
+	for desc, test := range map[string]struct {
+		src      string
+		expected string
+	}{
+		"should resolve known token": {
+			src:      "@podresources",
+			expected: "/var/lib/kubelet/pod-resources",
+		},
+		"should keep unknown token as literal path": {
+			src:      "@unknown",
+			expected: "@unknown",
+		},
+		"should keep regular path": {
+			src:      "/hostrun",
+			expected: "/hostrun",
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, resolveMountSource(test.src, tokens))
+	}
+}
+
+func TestResolveSymbolicLinkCache(t *testing.T) {
+	g := generate.New()
+	c := newTestCRIContainerdService()
+	fakeOS := c.os.(*ostesting.FakeOS)
+	resolved := make(map[string]int)
+	fakeOS.ResolveSymbolicLinkFn = func(path string) (string, error) {
+		resolved[path]++
+		return path, nil
+	}
+	err := c.addOCIBindMounts(&g, []*runtime.Mount{
+		{ContainerPath: "/test-container-path-1", HostPath: "/test-host-path"},
+		{ContainerPath: "/test-container-path-2", HostPath: "/test-host-path"},
+		{ContainerPath: "/test-container-path-3", HostPath: "/test-other-host-path"},
+	}, "", nil, cgroupMountReadOnly)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"/test-host-path":       1,
+		"/test-other-host-path": 1,
+	}, resolved)
+}
+
+func TestAddOCIDevicesError(t *testing.T) {
+	for desc, test := range map[string]struct {
+		statErr     error
+		optional    []string
+		expectErr   string
+		expectSkips bool
+	}{
+		"should report missing device": {
+			statErr:   os.ErrNotExist,
+			expectErr: `device "/dev/test" does not exist on the host`,
+		},
+		"should report permission issue": {
+			statErr:   os.ErrPermission,
+			expectErr: `permission denied to access device "/dev/test"`,
+		},
+		"should skip missing optional device": {
+			statErr:     os.ErrNotExist,
+			optional:    []string{"/dev/test"},
+			expectSkips: true,
+		},
+		"should not skip optional device with permission issue": {
+			statErr:   os.ErrPermission,
+			optional:  []string{"/dev/test"},
+			expectErr: `permission denied to access device "/dev/test"`,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
 		c := newTestCRIContainerdService()
-		mounts := c.generateContainerMounts(testSandboxRootDir, config)
-		assert.Equal(t, test.expectedMounts, mounts, desc)
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeOS.StatFn = func(string) (os.FileInfo, error) {
+			return nil, test.statErr
+		}
+		err := c.addOCIDevices(&g, []*runtime.Device{{
+			ContainerPath: "/dev/test",
+			HostPath:      "/dev/test",
+			Permissions:   "rwm",
+		}}, test.optional)
+		if test.expectSkips {
+			assert.NoError(t, err)
+			assert.Empty(t, g.Spec().Linux.Devices)
+			continue
+		}
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), test.expectErr)
 	}
 }
 
@@ -566,7 +2027,7 @@ func TestPrivilegedBindMount(t *testing.T) {
 		g := generate.New()
 		g.SetRootReadonly(test.readonlyRootFS)
 		c := newTestCRIContainerdService()
-		c.addOCIBindMounts(&g, nil, "")
+		c.addOCIBindMounts(&g, nil, "", nil, cgroupMountReadOnly)
 		if test.privileged {
 			setOCIBindMountsPrivileged(&g)
 		}
@@ -584,6 +2045,54 @@ func TestPrivilegedBindMount(t *testing.T) {
 	}
 }
 
+func TestCgroupMountMode(t *testing.T) {
+	for desc, test := range map[string]struct {
+		defaultMode string
+		annotations map[string]string
+		expectMount bool
+		expectRO    bool
+		expectErr   bool
+	}{
+		"should mount cgroup readonly by default": {
+			expectMount: true,
+			expectRO:    true,
+		},
+		"should mount cgroup with node default": {
+			defaultMode: cgroupMountNone,
+		},
+		"should mount cgroup writable when requested": {
+			annotations: map[string]string{cgroupMountAnnotation: cgroupMountReadWrite},
+			expectMount: true,
+		},
+		"should not mount cgroup when disabled by annotation": {
+			annotations: map[string]string{cgroupMountAnnotation: cgroupMountNone},
+		},
+		"should return error for invalid mode": {
+			annotations: map[string]string{cgroupMountAnnotation: "invalid"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		mode, err := getCgroupMountMode(test.defaultMode, test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		g := generate.New()
+		c := newTestCRIContainerdService()
+		require.NoError(t, c.addOCIBindMounts(&g, nil, "", nil, mode))
+		found := false
+		for _, m := range g.Spec().Mounts {
+			if m.Destination == "/sys/fs/cgroup" {
+				found = true
+				assert.Equal(t, test.expectRO, util.InStringSlice(m.Options, "ro"))
+			}
+		}
+		assert.Equal(t, test.expectMount, found)
+	}
+}
+
 func TestMountPropagation(t *testing.T) {
 	sharedLookupMountFn := func(string) (mount.Info, error) {
 		return mount.Info{
@@ -675,7 +2184,7 @@ func TestMountPropagation(t *testing.T) {
 		g := generate.New()
 		c := newTestCRIContainerdService()
 		c.os.(*ostesting.FakeOS).LookupMountFn = test.fakeLookupMountFn
-		err := c.addOCIBindMounts(&g, []*runtime.Mount{test.criMount}, "")
+		err := c.addOCIBindMounts(&g, []*runtime.Mount{test.criMount}, "", nil, cgroupMountReadOnly)
 		if test.expectErr {
 			require.Error(t, err)
 		} else {
@@ -685,6 +2194,236 @@ func TestMountPropagation(t *testing.T) {
 	}
 }
 
+func TestMaxContainerMounts(t *testing.T) {
+	mounts := []*runtime.Mount{
+		{ContainerPath: "container-path-1", HostPath: "host-path-1"},
+		{ContainerPath: "container-path-2", HostPath: "host-path-2"},
+	}
+	for desc, test := range map[string]struct {
+		limit     int
+		expectErr bool
+	}{
+		"should not limit mounts by default": {},
+		"should allow mounts within the limit": {
+			limit: 2,
+		},
+		"should return error if mounts exceed the limit": {
+			limit:     1,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		c := newTestCRIContainerdService()
+		c.config.MaxContainerMounts = test.limit
+		err := c.addOCIBindMounts(&g, mounts, "", nil, cgroupMountReadOnly)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestCreateMissingMountHostPath(t *testing.T) {
+	for desc, test := range map[string]struct {
+		mountOpts   map[string]mountOptions
+		expectedDir string
+		expectFile  bool
+	}{
+		"should create directory for missing host path by default": {
+			expectedDir: "/test/host-path",
+		},
+		"should create file for missing host path of file mount": {
+			mountOpts: map[string]mountOptions{
+				"/etc/config": {Type: mountTypeFile},
+			},
+			expectedDir: "/test",
+			expectFile:  true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		g := generate.New()
+		c := newTestCRIContainerdService()
+		fakeOS := c.os.(*ostesting.FakeOS)
+		fakeOS.StatFn = func(string) (os.FileInfo, error) {
+			return nil, os.ErrNotExist
+		}
+		var createdDir, createdFile string
+		fakeOS.MkdirAllFn = func(path string, _ os.FileMode) error {
+			createdDir = path
+			return nil
+		}
+		fakeOS.WriteFileFn = func(path string, _ []byte, _ os.FileMode) error {
+			createdFile = path
+			return nil
+		}
+		err := c.addOCIBindMounts(&g, []*runtime.Mount{{
+			ContainerPath: "/etc/config",
+			HostPath:      "/test/host-path",
+		}}, "", test.mountOpts, cgroupMountReadOnly)
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedDir, createdDir)
+		if test.expectFile {
+			assert.Equal(t, "/test/host-path", createdFile)
+		} else {
+			assert.Empty(t, createdFile)
+		}
+		checkMount(t, g.Spec().Mounts, "/test/host-path", "/etc/config", "bind", []string{"rbind"}, nil)
+	}
+}
+
+func TestGetMountOptions(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    map[string]mountOptions
+		expectErr   bool
+	}{
+		"should return empty options without annotation": {
+			expected: map[string]mountOptions{},
+		},
+		"should decode selinux relabel mode": {
+			annotations: map[string]string{
+				mountOptionsAnnotation: `{"/a":{"selinuxRelabel":"z"},"/b":{"selinuxRelabel":"Z"}}`,
+			},
+			expected: map[string]mountOptions{
+				"/a": {SelinuxRelabel: selinuxRelabelShared},
+				"/b": {SelinuxRelabel: selinuxRelabelPrivate},
+			},
+		},
+		"should return error for invalid selinux relabel mode": {
+			annotations: map[string]string{
+				mountOptionsAnnotation: `{"/a":{"selinuxRelabel":"x"}}`,
+			},
+			expectErr: true,
+		},
+		"should return error for malformed annotation": {
+			annotations: map[string]string{
+				mountOptionsAnnotation: `{"/a":`,
+			},
+			expectErr: true,
+		},
+		"should decode allowed extra options": {
+			annotations: map[string]string{
+				mountOptionsAnnotation: `{"/a":{"options":["nosuid","noexec"]}}`,
+			},
+			expected: map[string]mountOptions{
+				"/a": {Options: []string{"nosuid", "noexec"}},
+			},
+		},
+		"should return error for disallowed extra option": {
+			annotations: map[string]string{
+				mountOptionsAnnotation: `{"/a":{"options":["nosuid","suid"]}}`,
+			},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		mountOpts, err := getMountOptions(test.annotations)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, mountOpts)
+	}
+}
+
+func TestValidateMounts(t *testing.T) {
+	for desc, test := range map[string]struct {
+		mounts    []*runtime.Mount
+		expectErr string
+	}{
+		"should pass valid mounts": {
+			mounts: []*runtime.Mount{
+				{ContainerPath: "/data", HostPath: "/host/data"},
+				{ContainerPath: "/config", HostPath: "/host/config", Readonly: true},
+			},
+		},
+		"should pass no mounts": {},
+		"should list all problems": {
+			mounts: []*runtime.Mount{
+				{ContainerPath: "", HostPath: "/host/a"},
+				{ContainerPath: "relative", HostPath: "/host/b"},
+				{ContainerPath: "/", HostPath: "/host/c"},
+				{ContainerPath: "/d"},
+			},
+			expectErr: "invalid mounts: mount 0 has empty container path; " +
+				`container path "relative" of mount 1 is not absolute; ` +
+				"mount 2 can't be mounted over the root filesystem; " +
+				`mount 3 at "/d" has empty host path`,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateMounts(test.mounts)
+		if test.expectErr != "" {
+			assert.EqualError(t, err, test.expectErr)
+			continue
+		}
+		assert.NoError(t, err)
+	}
+}
+
+func TestRootfsPropagation(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	slaveLookupMountFn := func(string) (mount.Info, error) {
+		return mount.Info{
+			Mountpoint: "host-path",
+			Optional:   "master:",
+		}, nil
+	}
+	for desc, test := range map[string]struct {
+		propagation string
+		criMount    *runtime.Mount
+		expected    string
+		expectErr   bool
+	}{
+		"should set explicit rootfs propagation": {
+			propagation: "slave",
+			expected:    "rslave",
+		},
+		"should make rootfs propagation more permissive for host to container mount": {
+			propagation: "private",
+			criMount: &runtime.Mount{
+				ContainerPath: "/container-path",
+				HostPath:      "host-path",
+				Propagation:   runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER,
+			},
+			expected: "rslave",
+		},
+		"should not make rootfs propagation less permissive for host to container mount": {
+			propagation: "shared",
+			criMount: &runtime.Mount{
+				ContainerPath: "/container-path",
+				HostPath:      "host-path",
+				Propagation:   runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER,
+			},
+			expected: "rshared",
+		},
+		"should return error for invalid rootfs propagation": {
+			propagation: "invalid",
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+		config.Annotations[rootfsPropagationAnnotation] = test.propagation
+		if test.criMount != nil {
+			config.Mounts = append(config.Mounts, test.criMount)
+		}
+		c := newTestCRIContainerdService()
+		c.os.(*ostesting.FakeOS).LookupMountFn = slaveLookupMountFn
+		spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Linux.RootfsPropagation)
+	}
+}
+
 func TestPidNamespace(t *testing.T) {
 	testID := "test-id"
 	testPid := uint32(1234)
@@ -692,7 +2431,7 @@ func TestPidNamespace(t *testing.T) {
 	c := newTestCRIContainerdService()
 	t.Logf("should not set pid namespace when host pid is true")
 	config.Linux.SecurityContext.NamespaceOptions = &runtime.NamespaceOption{HostPid: true}
-	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+	spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
 	require.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 	for _, ns := range spec.Linux.Namespaces {
@@ -701,7 +2440,7 @@ func TestPidNamespace(t *testing.T) {
 
 	t.Logf("should set pid namespace when host pid is false")
 	config.Linux.SecurityContext.NamespaceOptions = &runtime.NamespaceOption{HostPid: false}
-	spec, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil)
+	spec, err = c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
 	require.NoError(t, err)
 	specCheck(t, testID, testPid, spec)
 	assert.Contains(t, spec.Linux.Namespaces, runtimespec.LinuxNamespace{
@@ -710,11 +2449,22 @@ func TestPidNamespace(t *testing.T) {
 }
 
 func TestDefaultRuntimeSpec(t *testing.T) {
-	spec, err := defaultRuntimeSpec("test-id")
+	spec, err := defaultRuntimeSpec(k8sContainerdNamespace, "test-id", false)
 	assert.NoError(t, err)
 	for _, mount := range spec.Mounts {
 		assert.NotEqual(t, "/run", mount.Destination)
 	}
+
+	t.Logf("should keep /run mount if required")
+	spec, err = defaultRuntimeSpec(k8sContainerdNamespace, "test-id", true)
+	assert.NoError(t, err)
+	found := false
+	for _, mount := range spec.Mounts {
+		if mount.Destination == "/run" {
+			found = true
+		}
+	}
+	assert.True(t, found)
 }
 
 func TestGenerateSeccompSpecOpts(t *testing.T) {
@@ -778,6 +2528,176 @@ func TestGenerateSeccompSpecOpts(t *testing.T) {
 	}
 }
 
+func TestInlineSeccompProfile(t *testing.T) {
+	rawProfile := `{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read","write"],"action":"SCMP_ACT_ALLOW"}]}`
+	expected := &runtimespec.LinuxSeccomp{
+		DefaultAction: runtimespec.ActErrno,
+		Syscalls: []runtimespec.LinuxSyscall{
+			{Names: []string{"read", "write"}, Action: runtimespec.ActAllow},
+		},
+	}
+	for desc, test := range map[string]struct {
+		content   string
+		expectErr bool
+	}{
+		"should accept raw profile": {
+			content: rawProfile,
+		},
+		"should accept base64 encoded profile": {
+			content: base64.StdEncoding.EncodeToString([]byte(rawProfile)),
+		},
+		"should return error for invalid base64": {
+			content:   "not-base64!",
+			expectErr: true,
+		},
+		"should return error for malformed json": {
+			content:   `{"defaultAction":`,
+			expectErr: true,
+		},
+		"should return error for trailing data": {
+			content:   rawProfile + `{}`,
+			expectErr: true,
+		},
+		"should return error for missing default action": {
+			content:   `{"syscalls":[]}`,
+			expectErr: true,
+		},
+		"should return error for unsupported action": {
+			content:   `{"defaultAction":"SCMP_ACT_NOTIFY"}`,
+			expectErr: true,
+		},
+		"should return error for rule without syscall names": {
+			content:   `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"action":"SCMP_ACT_ERRNO"}]}`,
+			expectErr: true,
+		},
+		"should return error for too large profile": {
+			content:   `{"defaultAction":"SCMP_ACT_ALLOW"` + strings.Repeat(" ", maxInlineSeccompProfileSize) + `}`,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		specOpts, err := generateSeccompSpecOpts(inlineProfilePrefix+test.content, false, true)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		spec := &runtimespec.Spec{Linux: &runtimespec.Linux{}}
+		require.NoError(t, specOpts(context.Background(), nil, nil, spec))
+		assert.Equal(t, expected, spec.Linux.Seccomp)
+	}
+}
+
+func TestWithAllowedSyscalls(t *testing.T) {
+	for desc, test := range map[string]struct {
+		syscalls  []string
+		profile   *runtimespec.LinuxSeccomp
+		expected  *runtimespec.LinuxSeccomp
+		expectErr bool
+	}{
+		"should allow only the named syscalls": {
+			syscalls: []string{"keyctl", "add_key"},
+			profile: &runtimespec.LinuxSeccomp{
+				DefaultAction: runtimespec.ActErrno,
+				Syscalls:      []runtimespec.LinuxSyscall{{Names: []string{"read"}, Action: runtimespec.ActAllow}},
+			},
+			expected: &runtimespec.LinuxSeccomp{
+				DefaultAction: runtimespec.ActErrno,
+				Syscalls: []runtimespec.LinuxSyscall{
+					{Names: []string{"read"}, Action: runtimespec.ActAllow},
+					{Names: []string{"keyctl", "add_key"}, Action: runtimespec.ActAllow},
+				},
+			},
+		},
+		"should not change profile allowing all syscalls by default": {
+			syscalls: []string{"keyctl"},
+			profile:  &runtimespec.LinuxSeccomp{DefaultAction: runtimespec.ActAllow},
+			expected: &runtimespec.LinuxSeccomp{DefaultAction: runtimespec.ActAllow},
+		},
+		"should return error without seccomp profile": {
+			syscalls:  []string{"keyctl"},
+			expectErr: true,
+		},
+		"should return error for invalid syscall name": {
+			syscalls:  []string{"keyctl", "KEYCTL;"},
+			profile:   &runtimespec.LinuxSeccomp{DefaultAction: runtimespec.ActErrno},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{Linux: &runtimespec.Linux{Seccomp: test.profile}}
+		opts, err := withAllowedSyscalls(test.syscalls)
+		if err == nil {
+			err = opts(context.Background(), nil, nil, spec)
+		}
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, spec.Linux.Seccomp)
+	}
+}
+
+func TestUnconfinedSeccompNoNewPrivs(t *testing.T) {
+	testID := "test-id"
+	testPid := uint32(1234)
+	for _, profile := range []string{"", unconfinedProfile} {
+		for _, noNewPrivs := range []bool{true, false} {
+			t.Logf("TestCase seccomp profile %q, no new privs %v", profile, noNewPrivs)
+			specOpts, err := generateSeccompSpecOpts(profile, false, true)
+			require.NoError(t, err)
+			assert.Nil(t, specOpts, "unconfined seccomp should be the same as unset")
+
+			config, sandboxConfig, imageConfig, _ := getCreateContainerTestData()
+			config.Linux.SecurityContext.SeccompProfilePath = profile
+			config.Linux.SecurityContext.NoNewPrivs = noNewPrivs
+			c := newTestCRIContainerdService()
+			spec, err := c.generateContainerSpec(testID, testPid, config, sandboxConfig, imageConfig, nil, nil)
+			require.NoError(t, err)
+			assert.Equal(t, noNewPrivs, spec.Process.NoNewPrivileges)
+		}
+	}
+}
+
+func TestCheckSeccompProfileSupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-seccomp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for desc, test := range map[string]struct {
+		profile   string
+		expectErr bool
+	}{
+		"should accept profile without notify action": {
+			profile: `{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read"],"action":"SCMP_ACT_ALLOW"}]}`,
+		},
+		"should reject profile with notify default action": {
+			profile:   `{"defaultAction":"SCMP_ACT_NOTIFY"}`,
+			expectErr: true,
+		},
+		"should reject profile with notify syscall action": {
+			profile:   `{"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["mount"],"action":"SCMP_ACT_NOTIFY"}]}`,
+			expectErr: true,
+		},
+		"should reject malformed profile": {
+			profile:   `{"defaultAction":`,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		path := filepath.Join(dir, "profile.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte(test.profile), 0644))
+		err := checkSeccompProfileSupported(profileNamePrefix + path)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	t.Logf("should skip non-localhost profile")
+	assert.NoError(t, checkSeccompProfileSupported(runtimeDefault))
+}
+
 func TestGenerateApparmorSpecOpts(t *testing.T) {
 	for desc, test := range map[string]struct {
 		profile    string
@@ -828,7 +2748,7 @@ func TestGenerateApparmorSpecOpts(t *testing.T) {
 		},
 	} {
 		t.Logf("TestCase %q", desc)
-		specOpts, err := generateApparmorSpecOpts(test.profile, test.privileged, !test.disable)
+		specOpts, err := generateApparmorSpecOpts(test.profile, test.privileged, !test.disable, "")
 		assert.Equal(t,
 			reflect.ValueOf(test.specOpts).Pointer(),
 			reflect.ValueOf(specOpts).Pointer())
@@ -839,3 +2759,36 @@ func TestGenerateApparmorSpecOpts(t *testing.T) {
 		}
 	}
 }
+
+func TestApparmorDefaultProfilePolicy(t *testing.T) {
+	failedOpts := func(context.Context, *containerd.Client, *containers.Container, *runtimespec.Spec) error {
+		return errors.New("failed to load profile")
+	}
+	for desc, test := range map[string]struct {
+		opts      containerd.SpecOpts
+		expectErr bool
+	}{
+		"should fall back to unconfined when profile fails to be applied": {
+			opts: withApparmorFallback(failedOpts),
+		},
+		"should fail when profile fails to be applied without fallback": {
+			opts:      failedOpts,
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		spec := &runtimespec.Spec{Process: &runtimespec.Process{ApparmorProfile: "test-profile"}}
+		err := test.opts(context.Background(), nil, &containers.Container{ID: "test-id"}, spec)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Empty(t, spec.Process.ApparmorProfile)
+	}
+	_, err := generateApparmorSpecOpts("", false, true, "invalid")
+	assert.Error(t, err)
+	specOpts, err := generateApparmorSpecOpts(runtimeDefault, false, true, apparmorPolicyUnconfined)
+	assert.NoError(t, err)
+	assert.NotNil(t, specOpts)
+}
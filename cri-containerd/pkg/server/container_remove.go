@@ -81,6 +81,14 @@ func (c *criContainerdService) RemoveContainer(ctx context.Context, r *runtime.R
 		return nil, fmt.Errorf("failed to remove container root directory %q: %v",
 			containerRootDir, err)
 	}
+	if fifoDir := getContainerFIFODir(c.config.RootDir, c.config.FIFODir, id); fifoDir != containerRootDir {
+		if err := system.EnsureRemoveAll(fifoDir); err != nil {
+			return nil, fmt.Errorf("failed to remove container fifo directory %q: %v",
+				fifoDir, err)
+		}
+	}
+
+	releaseDevices(id, container.Config.GetAnnotations())
 
 	c.containerStore.Delete(id)
 
@@ -18,6 +18,7 @@ package server
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/containerd/containerd"
@@ -70,6 +71,13 @@ func (c *criContainerdService) stopContainer(ctx context.Context, container cont
 		return nil
 	}
 
+	if timeout == 0 {
+		// Use the stop timeout specified at creation, which is validated and
+		// persisted with the container config.
+		if t, err := getStopTimeout(container.Config); err == nil {
+			timeout = t
+		}
+	}
 	if timeout > 0 {
 		stopSignal := unix.SIGTERM
 		image, err := c.imageStore.Get(container.ImageRef)
@@ -168,3 +176,20 @@ func (c *criContainerdService) waitContainerStop(ctx context.Context, id string,
 		}
 	}
 }
+
+// getStopTimeout returns the stop timeout specified in the container annotations,
+// or 0 if it is not specified.
+func getStopTimeout(config *runtime.ContainerConfig) (time.Duration, error) {
+	v, ok := config.GetAnnotations()[stopTimeoutAnnotation]
+	if !ok {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid stop timeout %q: %v", v, err)
+	}
+	if seconds < 0 {
+		return 0, fmt.Errorf("invalid stop timeout %q: must not be negative", v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
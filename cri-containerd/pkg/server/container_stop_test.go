@@ -22,6 +22,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	containerstore "github.com/kubernetes-incubator/cri-containerd/pkg/store/container"
 )
@@ -85,3 +86,34 @@ func TestWaitContainerStop(t *testing.T) {
 		assert.Equal(t, test.expectErr, err != nil, desc)
 	}
 }
+
+func TestGetStopTimeout(t *testing.T) {
+	for desc, test := range map[string]struct {
+		annotations map[string]string
+		expected    time.Duration
+		expectErr   bool
+	}{
+		"should return 0 if stop timeout is not specified": {},
+		"should return specified stop timeout": {
+			annotations: map[string]string{stopTimeoutAnnotation: "30"},
+			expected:    30 * time.Second,
+		},
+		"should return error for invalid stop timeout": {
+			annotations: map[string]string{stopTimeoutAnnotation: "30s"},
+			expectErr:   true,
+		},
+		"should return error for negative stop timeout": {
+			annotations: map[string]string{stopTimeoutAnnotation: "-1"},
+			expectErr:   true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		timeout, err := getStopTimeout(&runtime.ContainerConfig{Annotations: test.annotations})
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, timeout)
+	}
+}
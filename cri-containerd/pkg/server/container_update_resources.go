@@ -69,7 +69,7 @@ func (c *criContainerdService) updateContainerResources(ctx context.Context,
 	if err != nil {
 		return fmt.Errorf("failed to get container spec: %v", err)
 	}
-	newSpec, err := updateOCILinuxResource(oldSpec, resources)
+	newSpec, err := updateOCILinuxResource(oldSpec, resources, c.cgroupV2)
 	if err != nil {
 		return fmt.Errorf("failed to update resource in spec: %v", err)
 	}
@@ -127,7 +127,7 @@ func updateContainerSpec(ctx context.Context, cntr containerd.Container, spec *r
 }
 
 // updateOCILinuxResource updates container resource limit.
-func updateOCILinuxResource(spec *runtimespec.Spec, new *runtime.LinuxContainerResources) (*runtimespec.Spec, error) {
+func updateOCILinuxResource(spec *runtimespec.Spec, new *runtime.LinuxContainerResources, cgroupV2 bool) (*runtimespec.Spec, error) {
 	// Copy to make sure old spec is not changed.
 	cloned, err := conversion.NewCloner().DeepCopy(spec)
 	if err != nil {
@@ -142,7 +142,11 @@ func updateOCILinuxResource(spec *runtimespec.Spec, new *runtime.LinuxContainerR
 		g.SetLinuxResourcesCPUQuota(new.GetCpuQuota())
 	}
 	if new.GetCpuShares() != 0 {
-		g.SetLinuxResourcesCPUShares(uint64(new.GetCpuShares()))
+		shares := uint64(new.GetCpuShares())
+		if cgroupV2 {
+			shares = cgroupV2CPUShares(shares)
+		}
+		g.SetLinuxResourcesCPUShares(shares)
 	}
 	if new.GetMemoryLimitInBytes() != 0 {
 		g.SetLinuxResourcesMemoryLimit(new.GetMemoryLimitInBytes())
@@ -150,7 +150,7 @@ func TestUpdateOCILinuxResource(t *testing.T) {
 		},
 	} {
 		t.Logf("TestCase %q", desc)
-		got, err := updateOCILinuxResource(test.spec, test.resources)
+		got, err := updateOCILinuxResource(test.spec, test.resources, false)
 		if test.expectErr {
 			assert.Error(t, err)
 		} else {
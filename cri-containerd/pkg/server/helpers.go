@@ -17,6 +17,7 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -24,11 +25,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/containerd/cgroups"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
 	"github.com/docker/distribution/reference"
 	imagedigest "github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
@@ -37,6 +40,7 @@ import (
 	"github.com/opencontainers/selinux/go-selinux"
 	"github.com/opencontainers/selinux/go-selinux/label"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
 	"github.com/kubernetes-incubator/cri-containerd/pkg/store"
@@ -63,6 +67,15 @@ const (
 	defaultSandboxOOMAdj = -998
 	// defaultSandboxCPUshares is default cpu shares for sandbox container.
 	defaultSandboxCPUshares = 2
+	// minCPUShares and maxCPUShares are the cpu shares range which runtime converts
+	// to cgroup v2 cpu weight [1, 10000].
+	minCPUShares = 2
+	maxCPUShares = 262144
+	// cgroupfsRoot is the mount point of cgroup filesystem.
+	cgroupfsRoot = "/sys/fs/cgroup"
+	// cgroupV1CheckHierarchy is the cgroup v1 hierarchy the cgroupfs cgroup parent is
+	// checked against.
+	cgroupV1CheckHierarchy = "memory"
 	// defaultShmSize is the default size of the sandbox shm.
 	defaultShmSize = int64(1024 * 1024 * 64)
 	// relativeRootfsPath is the rootfs path relative to bundle path.
@@ -79,6 +92,11 @@ const (
 	// According to http://man7.org/linux/man-pages/man5/resolv.conf.5.html:
 	// "The search list is currently limited to six domains with a total of 256 characters."
 	maxDNSSearches = 6
+	// maxDNSSearchListChars is the max total length of the search list.
+	maxDNSSearchListChars = 256
+	// maxDNSNameservers is the max number of nameservers used by the resolver, which is
+	// MAXNS in resolv.h.
+	maxDNSNameservers = 3
 	// Delimiter used to construct container/sandbox names.
 	nameDelimiter = "_"
 	// netNSFormat is the format of network namespace of a process.
@@ -93,6 +111,8 @@ const (
 	etcHosts = "/etc/hosts"
 	// resolvConfPath is the abs path of resolv.conf on host or container.
 	resolvConfPath = "/etc/resolv.conf"
+	// etcLocaltime is the abs path of localtime file on host or container.
+	etcLocaltime = "/etc/localtime"
 )
 
 const (
@@ -111,6 +131,85 @@ const (
 	sandboxMetadataExtension = criContainerdPrefix + ".sandbox.metadata"
 	// containerMetadataExtension is an extension name that identify metadata of container in CreateContainerRequest
 	containerMetadataExtension = criContainerdPrefix + ".container.metadata"
+	// mountOptionsAnnotation is a container annotation carrying mount options which are not
+	// supported by CRI yet. The value is a json map from container path to mountOptions.
+	mountOptionsAnnotation = criContainerdPrefix + ".mount-options"
+	// rootfsPropagationAnnotation is a container annotation specifying the rootfs propagation
+	// of the container, either "private", "slave" or "shared".
+	rootfsPropagationAnnotation = criContainerdPrefix + ".rootfs-propagation"
+	// optionalDevicesAnnotation is a container annotation listing comma separated host paths
+	// of optional devices, which are skipped with a warning if they don't exist on the host.
+	optionalDevicesAnnotation = criContainerdPrefix + ".optional-devices"
+	// entrypointFileAnnotation is a container annotation specifying a file inside the
+	// container rootfs, which contains the command to run in place of the entrypoint.
+	entrypointFileAnnotation = criContainerdPrefix + ".entrypoint-file"
+	// stopTimeoutAnnotation is a container annotation specifying the grace period in
+	// seconds before the container is killed, when it is stopped without a timeout,
+	// e.g. when the sandbox is stopped.
+	stopTimeoutAnnotation = criContainerdPrefix + ".stop-timeout"
+	// hostnameAnnotation is a container annotation overriding the hostname of the
+	// container when SetContainerHostname is enabled. A container with a hostname
+	// different from the sandbox runs in its own UTS namespace.
+	hostnameAnnotation = criContainerdPrefix + ".hostname"
+	// cgroupsPathAnnotation is a container annotation specifying a pre-created cgroups
+	// path for the container, overriding the path under the sandbox cgroup parent.
+	cgroupsPathAnnotation = criContainerdPrefix + ".cgroups-path"
+	// deviceResourceAnnotationPrefix is the prefix of container annotations requesting
+	// a number of resources from the registered device provider, e.g.
+	// "io.cri-containerd.resource.nvidia.com/gpu": "2".
+	deviceResourceAnnotationPrefix = criContainerdPrefix + ".resource."
+	// hooksAnnotation is a container annotation specifying OCI hooks of the container,
+	// in the JSON format of the OCI runtime spec hooks.
+	hooksAnnotation = criContainerdPrefix + ".hooks"
+	// cgroupMountAnnotation is a container annotation specifying how the cgroup
+	// filesystem is mounted into the container, one of cgroupMountModes.
+	cgroupMountAnnotation = criContainerdPrefix + ".cgroup-mount"
+	// initAnnotation is a container annotation which, when "true", runs the container
+	// process under the init binary configured on the node to reap zombies.
+	initAnnotation = criContainerdPrefix + ".init"
+	// containerInitPath is the path the init binary is mounted at in the container.
+	containerInitPath = "/dev/init"
+	// supplementalGroupNamesAnnotation is a container annotation listing comma separated
+	// supplementary group names, which are resolved against /etc/group in the image.
+	supplementalGroupNamesAnnotation = criContainerdPrefix + ".supplemental-group-names"
+	// persistentImageVolumesAnnotation is a container annotation which, when "true",
+	// keeps image volumes in the sandbox root directory keyed by container name and
+	// volume destination, so that their contents survive container recreation in
+	// the same sandbox.
+	persistentImageVolumesAnnotation = criContainerdPrefix + ".persistent-image-volumes"
+	// cdiDevicesAnnotation is a container annotation listing comma separated fully
+	// qualified CDI device names, e.g. "vendor.com/gpu=0", resolved by the registered
+	// CDI resolver.
+	cdiDevicesAnnotation = criContainerdPrefix + ".cdi-devices"
+	// rlimitsAnnotation is a container annotation, or an image label, listing comma
+	// separated rlimits in "name=soft[:hard]" format, e.g. "nofile=1024:4096".
+	rlimitsAnnotation = criContainerdPrefix + ".rlimits"
+	// ambientCapabilitiesAnnotation is a container annotation listing comma separated
+	// ambient capabilities in CRI format without "CAP_" prefix, e.g. "NET_BIND_SERVICE".
+	ambientCapabilitiesAnnotation = criContainerdPrefix + ".ambient-capabilities"
+	// procMountOptionsAnnotation is a container annotation listing comma separated
+	// extra options of the /proc mount, e.g. "hidepid=invisible,subset=pid".
+	procMountOptionsAnnotation = criContainerdPrefix + ".proc-mount-options"
+	// seccompAllowedSyscallsAnnotation is a container annotation listing comma separated
+	// syscalls to allow on top of the seccomp profile of the container.
+	seccompAllowedSyscallsAnnotation = criContainerdPrefix + ".seccomp-allowed-syscalls"
+	// overlayImageVolumesAnnotation is a container annotation which, when "true", mounts
+	// image volumes as overlay on top of the image content instead of copying the
+	// content into the volumes. It requires the overlayfs snapshotter.
+	overlayImageVolumesAnnotation = criContainerdPrefix + ".overlay-image-volumes"
+	// privilegedWithoutHostDevicesAnnotation is a container annotation which, when
+	// "true", grants a privileged container all capabilities and the privileged mounts,
+	// but only the devices explicitly requested instead of all host devices.
+	privilegedWithoutHostDevicesAnnotation = criContainerdPrefix + ".privileged-without-host-devices"
+	// skipDevShmAnnotation is a container annotation which, when "true", skips the
+	// sandbox /dev/shm mount, so that users could manage /dev/shm themselves, e.g.
+	// with a volume. The container gets the default tmpfs /dev/shm otherwise.
+	skipDevShmAnnotation = criContainerdPrefix + ".skip-dev-shm"
+	// maxContainerNameLength is the max length of the generated container name, which
+	// is used in the name index and containerd labels.
+	maxContainerNameLength = 1024
+	// maxHostnameLength is the max length of hostname, which is HOST_NAME_MAX on linux.
+	maxHostnameLength = 64
 )
 
 // makeSandboxName generates sandbox name from sandbox metadata. The name
@@ -139,6 +238,38 @@ func makeContainerName(c *runtime.ContainerMetadata, s *runtime.PodSandboxMetada
 	}, nameDelimiter)	// nameDelimiter为"_"
 }
 
+// validateContainerName validates the sandbox and container metadata used to
+// generate the container name. Unique metadata could generate the same name if
+// any field contains nameDelimiter, so it is disallowed together with spaces and
+// control characters.
+func validateContainerName(c *runtime.ContainerMetadata, s *runtime.PodSandboxMetadata) error {
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"container name", c.GetName()},
+		{"sandbox name", s.GetName()},
+		{"sandbox namespace", s.GetNamespace()},
+		{"sandbox uid", s.GetUid()},
+	} {
+		if field.value == "" {
+			return fmt.Errorf("%s is empty", field.name)
+		}
+		if strings.Contains(field.value, nameDelimiter) {
+			return fmt.Errorf("%s %q contains %q", field.name, field.value, nameDelimiter)
+		}
+		for _, r := range field.value {
+			if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+				return fmt.Errorf("%s %q contains invalid character %q", field.name, field.value, r)
+			}
+		}
+	}
+	if name := makeContainerName(c, s); len(name) > maxContainerNameLength {
+		return fmt.Errorf("container name %q exceeds the max length %d", name, maxContainerNameLength)
+	}
+	return nil
+}
+
 // getCgroupsPath generates container cgroups path.
 func getCgroupsPath(cgroupsParent, id string, systemdCgroup bool) string {
 	if systemdCgroup {
@@ -150,6 +281,245 @@ func getCgroupsPath(cgroupsParent, id string, systemdCgroup bool) string {
 	return filepath.Join(cgroupsParent, id)
 }
 
+// validateCgroupParent checks the syntax of the cgroup parent for the configured
+// cgroup driver. See checkCgroupParent for the checks against the host.
+func validateCgroupParent(cgroupsParent string, systemdCgroup bool) error {
+	if systemdCgroup {
+		// runc systemd cgroup driver only accepts a slice as parent.
+		if _, err := expandSlice(path.Base(cgroupsParent)); err != nil {
+			return fmt.Errorf("cgroup parent %q is not a valid systemd slice: %v", cgroupsParent, err)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(cgroupsParent) {
+		return fmt.Errorf("cgroup parent %q is not an absolute path", cgroupsParent)
+	}
+	// Do not allow the container cgroup to escape the cgroup hierarchy.
+	for _, part := range strings.Split(cgroupsParent, "/") {
+		if part == ".." {
+			return fmt.Errorf("cgroup parent %q should not contain \"..\"", cgroupsParent)
+		}
+	}
+	return nil
+}
+
+// expandSlice expands a systemd slice name to its cgroup path, the same as runc,
+// e.g. "a-b.slice" is "/a.slice/a-b.slice".
+func expandSlice(slice string) (string, error) {
+	const suffix = ".slice"
+	if !strings.HasSuffix(slice, suffix) || strings.Contains(slice, "/") {
+		return "", fmt.Errorf("invalid slice name %q", slice)
+	}
+	name := strings.TrimSuffix(slice, suffix)
+	if name == "-" {
+		// "-.slice" is the root slice.
+		return "/", nil
+	}
+	var p, prefix string
+	for _, component := range strings.Split(name, "-") {
+		if component == "" {
+			return "", fmt.Errorf("invalid slice name %q", slice)
+		}
+		p += "/" + prefix + component + suffix
+		prefix += component + "-"
+	}
+	return p, nil
+}
+
+// checkCgroupParent checks the container cgroup could be created under the cgroup
+// parent on the host, so that a missing or unusable parent is reported at creation
+// time instead of at container start. The systemd slice must exist. A missing cgroupfs
+// parent is created by runc, so the nearest existing ancestor must be a writable
+// directory.
+func (c *criContainerdService) checkCgroupParent(cgroupsParent string) error {
+	root := cgroupfsRoot
+	if c.config.SystemdCgroup {
+		if !c.cgroupV2 {
+			root = filepath.Join(cgroupfsRoot, "systemd")
+		}
+		slicePath, err := expandSlice(path.Base(cgroupsParent))
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(root, slicePath)
+		if _, err := c.os.Stat(p); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("systemd slice %q does not exist", cgroupsParent)
+			}
+			return fmt.Errorf("failed to stat systemd slice %q: %v", p, err)
+		}
+		return nil
+	}
+
+	if !c.cgroupV2 {
+		root = filepath.Join(cgroupfsRoot, cgroupV1CheckHierarchy)
+	}
+	p := filepath.Join(root, filepath.Clean(cgroupsParent))
+	for {
+		fi, err := c.os.Stat(p)
+		if err == nil {
+			if fi != nil && !fi.IsDir() {
+				return fmt.Errorf("cgroup %q is not a directory", p)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat cgroup %q: %v", p, err)
+		}
+		if p == root {
+			return fmt.Errorf("cgroup hierarchy %q does not exist", root)
+		}
+		p = filepath.Dir(p)
+	}
+	if c.cgroupWritable != nil {
+		if err := c.cgroupWritable(p); err != nil {
+			return fmt.Errorf("cgroup parent %q can't be created under %q: %v", cgroupsParent, p, err)
+		}
+	}
+	return nil
+}
+
+// validateCgroupsPathOverride validates the cgroups path override is under one of the
+// allowed prefixes. Override is not permitted if there is no allowed prefix. Both
+// paths are cleaned and compared by path components, the caller should use the
+// cleaned cgroups path.
+func validateCgroupsPathOverride(cgroupsPath string, allowedPrefixes []string, systemdCgroup bool) error {
+	if systemdCgroup {
+		return fmt.Errorf("cgroups path override is not supported with systemd cgroup")
+	}
+	if err := validateCgroupParent(cgroupsPath, false); err != nil {
+		return err
+	}
+	parts := cgroupPathComponents(cgroupsPath)
+	for _, prefix := range allowedPrefixes {
+		prefixParts := cgroupPathComponents(prefix)
+		// The cgroups path must be strictly under the prefix.
+		if len(parts) <= len(prefixParts) {
+			continue
+		}
+		matched := true
+		for i := range prefixParts {
+			if parts[i] != prefixParts[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("cgroups path %q is not under any allowed prefix %v", cgroupsPath, allowedPrefixes)
+}
+
+// cgroupPathComponents returns the components of the cleaned absolute cgroup path,
+// which is empty for "/".
+func cgroupPathComponents(p string) []string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// isCgroupV2 checks whether the host is running with cgroup v2 unified hierarchy.
+func isCgroupV2() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupfsRoot, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.CGROUP2_SUPER_MAGIC
+}
+
+// isProcMountOptionsV2Supported checks whether the kernel supports the procfs mount
+// options added in linux 5.8, i.e. "subset=pid" and named hidepid values.
+func isProcMountOptionsV2Supported() bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	return kernelVersionAtLeast(string(uts.Release[:bytes.IndexByte(uts.Release[:], 0)]), 5, 8)
+}
+
+// kernelVersionAtLeast checks whether the kernel release, e.g. "5.10.0-8-amd64", is
+// at least major.minor.
+func kernelVersionAtLeast(release string, major, minor int) bool {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	min, err := strconv.Atoi(strings.TrimFunc(parts[1], func(r rune) bool { return !unicode.IsDigit(r) }))
+	if err != nil {
+		return false
+	}
+	return maj > major || (maj == major && min >= minor)
+}
+
+// mountInfoCache looks up the mount info of paths from the mount table loaded at most
+// once, so that looking up many paths doesn't parse mountinfo repeatedly. It is not
+// safe for concurrent use, and should only live within a single request so that the
+// mount table is not stale.
+type mountInfoCache struct {
+	self   func() ([]mount.Info, error)
+	mounts []mount.Info
+	err    error
+	loaded bool
+}
+
+// newMountInfoCache creates a mountInfoCache loading the mount table with self, e.g.
+// mount.Self.
+func newMountInfoCache(self func() ([]mount.Info, error)) *mountInfoCache {
+	return &mountInfoCache{self: self}
+}
+
+// Lookup returns the mount info of the deepest mount containing the path. Among
+// mounts stacked on the same mount point, the last one in the mount table is on
+// top and returned.
+func (m *mountInfoCache) Lookup(path string) (mount.Info, error) {
+	if !m.loaded {
+		m.mounts, m.err = m.self()
+		m.loaded = true
+	}
+	if m.err != nil {
+		return mount.Info{}, m.err
+	}
+	path = filepath.Clean(path)
+	var found *mount.Info
+	for i, info := range m.mounts {
+		if path != info.Mountpoint && info.Mountpoint != "/" &&
+			!strings.HasPrefix(path, info.Mountpoint+"/") {
+			continue
+		}
+		// Keep the mount table order, so that a later mount on the same mount
+		// point overrides the earlier one.
+		if found == nil || len(info.Mountpoint) >= len(found.Mountpoint) {
+			found = &m.mounts[i]
+		}
+	}
+	if found == nil {
+		return mount.Info{}, fmt.Errorf("failed to find the mount info for %q", path)
+	}
+	return *found, nil
+}
+
+// cgroupV2CPUShares returns the cpu shares to set in the runtime spec on cgroup v2,
+// clamped to [minCPUShares, maxCPUShares] for a valid weight. 0 means not set.
+func cgroupV2CPUShares(shares uint64) uint64 {
+	if shares == 0 {
+		return 0
+	}
+	if shares < minCPUShares {
+		return minCPUShares
+	}
+	if shares > maxCPUShares {
+		return maxCPUShares
+	}
+	return shares
+}
+
 // getSandboxRootDir returns the root directory for managing sandbox files,
 // e.g. named pipes.
 // /rootDir/
@@ -162,6 +532,16 @@ func getContainerRootDir(rootDir, id string) string {
 	return filepath.Join(rootDir, containersDir, id)
 }
 
+// getContainerFIFODir returns the directory for the container FIFOs. It is the
+// container root directory unless a separate FIFO root directory is configured,
+// e.g. on tmpfs when the root directory is on slow storage.
+func getContainerFIFODir(rootDir, fifoRootDir, id string) string {
+	if fifoRootDir == "" {
+		return getContainerRootDir(rootDir, id)
+	}
+	return filepath.Join(fifoRootDir, containersDir, id)
+}
+
 // getSandboxHosts returns the hosts file path inside the sandbox root directory.
 func getSandboxHosts(sandboxRootDir string) string {
 	return filepath.Join(sandboxRootDir, "hosts")
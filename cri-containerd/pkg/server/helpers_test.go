@@ -17,11 +17,18 @@ limitations under the License.
 package server
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 
+	"github.com/containerd/containerd/mount"
 	imagedigest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	ostesting "github.com/kubernetes-incubator/cri-containerd/pkg/os/testing"
 	"github.com/kubernetes-incubator/cri-containerd/pkg/util"
 )
 
@@ -127,6 +134,165 @@ func TestGetCgroupsPath(t *testing.T) {
 	}
 }
 
+func TestValidateCgroupParent(t *testing.T) {
+	for desc, test := range map[string]struct {
+		cgroupsParent string
+		systemdCgroup bool
+		expectErr     bool
+	}{
+		"should accept absolute cgroupfs parent": {
+			cgroupsParent: "/a/b",
+		},
+		"should reject relative cgroupfs parent": {
+			cgroupsParent: "a/b",
+			expectErr:     true,
+		},
+		"should reject cgroupfs parent escaping the hierarchy": {
+			cgroupsParent: "/a/../../b",
+			expectErr:     true,
+		},
+		"should accept cgroupfs parent with dots in names": {
+			cgroupsParent: "/a..b/c..",
+		},
+		"should accept systemd slice parent": {
+			cgroupsParent: "/a.slice/a-b.slice",
+			systemdCgroup: true,
+		},
+		"should reject systemd slice with empty component": {
+			cgroupsParent: "a--b.slice",
+			systemdCgroup: true,
+			expectErr:     true,
+		},
+		"should reject systemd parent which is not a slice": {
+			cgroupsParent: "/a/b",
+			systemdCgroup: true,
+			expectErr:     true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateCgroupParent(test.cgroupsParent, test.systemdCgroup)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestExpandSlice(t *testing.T) {
+	for slice, expected := range map[string]string{
+		"-.slice":          "/",
+		"system.slice":     "/system.slice",
+		"kubepods-a.slice": "/kubepods.slice/kubepods-a.slice",
+	} {
+		p, err := expandSlice(slice)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, p)
+	}
+	for _, slice := range []string{"system", "a/b.slice", "-a.slice"} {
+		_, err := expandSlice(slice)
+		assert.Error(t, err, slice)
+	}
+}
+
+func TestCheckCgroupParent(t *testing.T) {
+	for desc, test := range map[string]struct {
+		cgroupsParent string
+		systemdCgroup bool
+		cgroupV2      bool
+		existing      map[string]bool
+		writableErr   error
+		expectErr     bool
+	}{
+		"should accept existing cgroupfs parent": {
+			cgroupsParent: "/kubepods/pod1",
+			existing:      map[string]bool{"/sys/fs/cgroup/memory/kubepods/pod1": true},
+		},
+		"should accept missing cgroupfs parent under writable ancestor": {
+			cgroupsParent: "/kubepods/pod1",
+			existing:      map[string]bool{"/sys/fs/cgroup/memory/kubepods": true},
+		},
+		"should check cgroupfs parent under unified hierarchy on cgroup v2": {
+			cgroupsParent: "/kubepods",
+			cgroupV2:      true,
+			existing:      map[string]bool{"/sys/fs/cgroup/kubepods": true},
+		},
+		"should reject cgroupfs parent under non-writable ancestor": {
+			cgroupsParent: "/kubepods/pod1",
+			existing:      map[string]bool{"/sys/fs/cgroup/memory": true},
+			writableErr:   unix.EROFS,
+			expectErr:     true,
+		},
+		"should reject cgroupfs parent without cgroup hierarchy": {
+			cgroupsParent: "/kubepods",
+			expectErr:     true,
+		},
+		"should accept existing systemd slice": {
+			cgroupsParent: "kubepods-burstable.slice",
+			systemdCgroup: true,
+			existing:      map[string]bool{"/sys/fs/cgroup/systemd/kubepods.slice/kubepods-burstable.slice": true},
+		},
+		"should reject missing systemd slice": {
+			cgroupsParent: "kubepods-burstable.slice",
+			systemdCgroup: true,
+			existing:      map[string]bool{"/sys/fs/cgroup/systemd/kubepods.slice": true},
+			expectErr:     true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		c := newTestCRIContainerdService()
+		c.config.SystemdCgroup = test.systemdCgroup
+		c.cgroupV2 = test.cgroupV2
+		c.os.(*ostesting.FakeOS).StatFn = func(p string) (os.FileInfo, error) {
+			if test.existing[p] {
+				return nil, nil
+			}
+			return nil, os.ErrNotExist
+		}
+		var checked string
+		c.cgroupWritable = func(p string) error {
+			checked = p
+			return test.writableErr
+		}
+		err := c.checkCgroupParent(test.cgroupsParent)
+		if test.expectErr {
+			assert.Error(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		if !test.systemdCgroup {
+			assert.True(t, test.existing[checked], "should check the nearest existing ancestor")
+		}
+	}
+}
+
+func TestCgroupV2CPUShares(t *testing.T) {
+	for desc, test := range map[string]struct {
+		shares   uint64
+		expected uint64
+	}{
+		"should keep unset shares": {
+			shares:   0,
+			expected: 0,
+		},
+		"should raise shares below the minimum": {
+			shares:   1,
+			expected: minCPUShares,
+		},
+		"should lower shares above the maximum": {
+			shares:   maxCPUShares + 1,
+			expected: maxCPUShares,
+		},
+		"should keep shares within the range": {
+			shares:   1024,
+			expected: 1024,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, cgroupV2CPUShares(test.shares))
+	}
+}
+
 func TestBuildLabels(t *testing.T) {
 	configLabels := map[string]string{
 		"a": "b",
@@ -142,3 +308,217 @@ func TestBuildLabels(t *testing.T) {
 	assert.Empty(t, configLabels[containerKindLabel], "should not add new labels into original label")
 	assert.Equal(t, "b", configLabels["a"], "change in new labels should not affect original label")
 }
+
+func TestValidateCgroupsPathOverride(t *testing.T) {
+	allowed := []string{"/kubepods/pinned/", "/special"}
+	for desc, test := range map[string]struct {
+		cgroupsPath   string
+		allowed       []string
+		systemdCgroup bool
+		expectErr     bool
+	}{
+		"should allow path under allowed prefix": {
+			cgroupsPath: "/kubepods/pinned/test",
+			allowed:     allowed,
+		},
+		"should allow path under allowed prefix without trailing slash": {
+			cgroupsPath: "/special/test",
+			allowed:     allowed,
+		},
+		"should reject path not under allowed prefix": {
+			cgroupsPath: "/specialist/test",
+			allowed:     allowed,
+			expectErr:   true,
+		},
+		"should reject the allowed prefix itself": {
+			cgroupsPath: "/special",
+			allowed:     allowed,
+			expectErr:   true,
+		},
+		"should reject path escaping allowed prefix": {
+			cgroupsPath: "/special/../test",
+			allowed:     allowed,
+			expectErr:   true,
+		},
+		"should allow path with redundant separators": {
+			cgroupsPath: "/kubepods//pinned/./test",
+			allowed:     allowed,
+		},
+		"should allow any path under the root prefix": {
+			cgroupsPath: "/test",
+			allowed:     []string{"/"},
+		},
+		"should reject the root itself under the root prefix": {
+			cgroupsPath: "/",
+			allowed:     []string{"/"},
+			expectErr:   true,
+		},
+		"should reject override without allowed prefix": {
+			cgroupsPath: "/special/test",
+			expectErr:   true,
+		},
+		"should reject override with systemd cgroup": {
+			cgroupsPath:   "/special/test",
+			allowed:       allowed,
+			systemdCgroup: true,
+			expectErr:     true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateCgroupsPathOverride(test.cgroupsPath, test.allowed, test.systemdCgroup)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestValidateContainerName(t *testing.T) {
+	for desc, test := range map[string]struct {
+		container *runtime.ContainerMetadata
+		sandbox   *runtime.PodSandboxMetadata
+		expectErr bool
+	}{
+		"should accept valid metadata": {
+			container: &runtime.ContainerMetadata{Name: "test-container", Attempt: 1},
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test-pod", Namespace: "default", Uid: "uid"},
+		},
+		"should return error for missing metadata": {
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test-pod", Namespace: "default", Uid: "uid"},
+			expectErr: true,
+		},
+		"should return error for name delimiter": {
+			container: &runtime.ContainerMetadata{Name: "test_container"},
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test-pod", Namespace: "default", Uid: "uid"},
+			expectErr: true,
+		},
+		"should return error for space": {
+			container: &runtime.ContainerMetadata{Name: "test-container"},
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test pod", Namespace: "default", Uid: "uid"},
+			expectErr: true,
+		},
+		"should return error for control character": {
+			container: &runtime.ContainerMetadata{Name: "test-container"},
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test-pod", Namespace: "default\x00", Uid: "uid"},
+			expectErr: true,
+		},
+		"should return error for too long name": {
+			container: &runtime.ContainerMetadata{Name: strings.Repeat("a", maxContainerNameLength)},
+			sandbox:   &runtime.PodSandboxMetadata{Name: "test-pod", Namespace: "default", Uid: "uid"},
+			expectErr: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		err := validateContainerName(test.container, test.sandbox)
+		if test.expectErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestKernelVersionAtLeast(t *testing.T) {
+	for release, expected := range map[string]bool{
+		"5.8.0":          true,
+		"5.10.0-8-amd64": true,
+		"6.1.0":          true,
+		"5.7.19":         false,
+		"4.19.0-generic": false,
+		"5.8-rc1":        true,
+		"invalid":        false,
+	} {
+		assert.Equal(t, expected, kernelVersionAtLeast(release, 5, 8), release)
+	}
+}
+
+func TestMountInfoCache(t *testing.T) {
+	loaded := 0
+	cache := newMountInfoCache(func() ([]mount.Info, error) {
+		loaded++
+		return []mount.Info{
+			{Mountpoint: "/", Optional: "shared:1"},
+			{Mountpoint: "/var/lib", Optional: "shared:2"},
+			{Mountpoint: "/var/lib/kubelet", Optional: "master:3"},
+		}, nil
+	})
+	for path, expected := range map[string]string{
+		"/":                       "/",
+		"/etc/hosts":              "/",
+		"/var/lib":                "/var/lib",
+		"/var/lib/docker":         "/var/lib",
+		"/var/lib/kubelet/pods/":  "/var/lib/kubelet",
+		"/var/lib/kubeletfoo/bar": "/var/lib",
+	} {
+		info, err := cache.Lookup(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, info.Mountpoint, path)
+	}
+	assert.Equal(t, 1, loaded, "mount table should only be loaded once")
+}
+
+func TestMountInfoCacheStackedMounts(t *testing.T) {
+	cache := newMountInfoCache(func() ([]mount.Info, error) {
+		return []mount.Info{
+			{Mountpoint: "/", Optional: "shared:1"},
+			{Mountpoint: "/var/lib/kubelet", Optional: "shared:2"},
+			{Mountpoint: "/var/lib", Optional: "shared:3"},
+			// The bind mount over /var/lib/kubelet is on top of the first one.
+			{Mountpoint: "/var/lib/kubelet", Optional: "master:4"},
+		}, nil
+	})
+	for path, expected := range map[string]string{
+		"/var/lib/kubelet":      "master:4",
+		"/var/lib/kubelet/pods": "master:4",
+		"/var/lib/docker":       "shared:3",
+	} {
+		info, err := cache.Lookup(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, info.Optional, path)
+	}
+}
+
+// fakeMountTable returns a mount table with n mounts, and simulates the cost of
+// parsing mountinfo for each load.
+func fakeMountTable(n int) func() ([]mount.Info, error) {
+	return func() ([]mount.Info, error) {
+		mounts := []mount.Info{{Mountpoint: "/", Optional: "shared:1"}}
+		for i := 0; i < n; i++ {
+			mounts = append(mounts, mount.Info{
+				Mountpoint: fmt.Sprintf("/var/lib/kubelet/pods/%d/volumes", i),
+				Optional:   fmt.Sprintf("shared:%d", i+2),
+			})
+		}
+		return mounts, nil
+	}
+}
+
+func BenchmarkMountLookupUncached(b *testing.B) {
+	self := fakeMountTable(5000)
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 20; j++ {
+			// Each lookup loads the mount table, like mount.Lookup.
+			if _, err := newMountInfoCache(self).Lookup(fmt.Sprintf("/var/lib/kubelet/pods/%d/volumes/data", j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMountLookupCached(b *testing.B) {
+	self := fakeMountTable(5000)
+	for i := 0; i < b.N; i++ {
+		cache := newMountInfoCache(self)
+		for j := 0; j < 20; j++ {
+			if _, err := cache.Lookup(fmt.Sprintf("/var/lib/kubelet/pods/%d/volumes/data", j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestGetContainerFIFODir(t *testing.T) {
+	assert.Equal(t, "/root/containers/test-id", getContainerFIFODir("/root", "", "test-id"))
+	assert.Equal(t, "/run/fifo/containers/test-id", getContainerFIFODir("/root", "/run/fifo", "test-id"))
+}
@@ -91,7 +91,8 @@ func (c *criContainerdService) recover(ctx context.Context) error {
 	for _, container := range containers {
 		// 获取容器根目录/var/lib/cri-containerd/ID
 		containerDir := getContainerRootDir(c.config.RootDir, container.ID())
-		cntr, err := loadContainer(ctx, container, containerDir)
+		fifoDir := getContainerFIFODir(c.config.RootDir, c.config.FIFODir, container.ID())
+		cntr, err := loadContainer(ctx, container, containerDir, fifoDir)
 		if err != nil {
 			glog.Errorf("Failed to load container %q: %v", container.ID(), err)
 			continue
@@ -136,12 +137,17 @@ func (c *criContainerdService) recover(ctx context.Context) error {
 	if err := cleanupOrphanedContainerDirs(containers, filepath.Join(c.config.RootDir, "containers")); err != nil {
 		return fmt.Errorf("failed to cleanup orphaned container directories: %v", err)
 	}
+	if c.config.FIFODir != "" {
+		if err := cleanupOrphanedContainerDirs(containers, filepath.Join(c.config.FIFODir, containersDir)); err != nil {
+			return fmt.Errorf("failed to cleanup orphaned container fifo directories: %v", err)
+		}
+	}
 
 	return nil
 }
 
 // loadContainer loads container from containerd and status checkpoint.
-func loadContainer(ctx context.Context, cntr containerd.Container, containerDir string) (containerstore.Container, error) {
+func loadContainer(ctx context.Context, cntr containerd.Container, containerDir, fifoDir string) (containerstore.Container, error) {
 	id := cntr.ID()
 	var container containerstore.Container
 	// Load container metadata.
@@ -213,7 +219,7 @@ func loadContainer(ctx context.Context, cntr containerd.Container, containerDir
 			// cri-containerd got restarted just during that. In that case, we still
 			// treat the container as `CREATED`.
 			containerIO, err = cio.NewContainerIO(id,
-				cio.WithNewFIFOs(containerDir, meta.Config.GetTty(), meta.Config.GetStdin()),
+				cio.WithNewFIFOs(fifoDir, meta.Config.GetTty(), meta.Config.GetStdin()),
 			)
 			if err != nil {
 				return container, fmt.Errorf("failed to create container io: %v", err)
@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd"
@@ -76,7 +78,7 @@ func (c *criContainerdService) portForward(id string, port int32, stream io.Read
 	// * socat: https://linux.die.net/man/1/socat
 	// * nsenter: http://man7.org/linux/man-pages/man1/nsenter.1.html
 	args := []string{"-t", fmt.Sprintf("%d", pid), "-n", socat,
-		"-", fmt.Sprintf("TCP4:localhost:%d", port)}
+		"-", portForwardAddress(pid, port)}
 
 	nsenter, err := exec.LookPath("nsenter")
 	if err != nil {
@@ -120,3 +122,56 @@ func (c *criContainerdService) portForward(id string, port int32, stream io.Read
 
 	return nil
 }
+
+const (
+	// ipv4Loopback and ipv4Any are 127.0.0.1 and 0.0.0.0 in /proc/net/tcp format.
+	ipv4Loopback = "0100007F"
+	ipv4Any      = "00000000"
+	// ipv6Loopback and ipv6Any are ::1 and :: in /proc/net/tcp6 format.
+	ipv6Loopback = "00000000000000000000000001000000"
+	ipv6Any      = "00000000000000000000000000000000"
+	// tcpListen is the LISTEN socket state in /proc/net/tcp and /proc/net/tcp6.
+	tcpListen = "0A"
+)
+
+// portForwardAddress returns the socat address to connect to the port inside the
+// network namespace of the process. The IPv4 loopback is preferred, and the IPv6
+// loopback is used if the port is only listened on IPv6, e.g. in an IPv6 only pod
+// or by a service only listening on ::1.
+func portForwardAddress(pid uint32, port int32) string {
+	// Errors are ignored, in which case the IPv4 loopback is used.
+	tcp, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/tcp", pid))
+	tcp6, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/tcp6", pid))
+	if !isTCPListening(tcp, port, false) && isTCPListening(tcp6, port, true) {
+		return fmt.Sprintf("TCP6:[::1]:%d", port)
+	}
+	return fmt.Sprintf("TCP4:localhost:%d", port)
+}
+
+// isTCPListening checks whether the port is listened on the loopback or the
+// unspecified address, based on the content of /proc/net/tcp or /proc/net/tcp6.
+func isTCPListening(data []byte, port int32, ipv6 bool) bool {
+	loopback, unspecified := ipv4Loopback, ipv4Any
+	if ipv6 {
+		loopback, unspecified = ipv6Loopback, ipv6Any
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// Format: sl local_address rem_address st ...
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		parts := strings.Split(fields[1], ":")
+		if len(parts) != 2 {
+			continue
+		}
+		p, err := strconv.ParseUint(parts[1], 16, 16)
+		if err != nil || p != uint64(port) {
+			continue
+		}
+		if parts[0] == loopback || parts[0] == unspecified {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTCPListening(t *testing.T) {
+	const (
+		tcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 1 0000000000000000 100 0 0 10 0
+   1: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12346 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:0016 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 12347 1 0000000000000000 100 0 0 10 0
+   3: 0A00000A:1F91 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12348 1 0000000000000000 100 0 0 10 0
+`
+		tcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1F92 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 22345 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000000000000:1F93 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 22346 1 0000000000000000 100 0 0 10 0
+`
+	)
+	for desc, test := range map[string]struct {
+		data     string
+		port     int32
+		ipv6     bool
+		expected bool
+	}{
+		"should detect port listening on ipv4 loopback": {
+			data:     tcp,
+			port:     8080,
+			expected: true,
+		},
+		"should detect port listening on ipv4 unspecified address": {
+			data:     tcp,
+			port:     80,
+			expected: true,
+		},
+		"should ignore socket not in listen state": {
+			data: tcp,
+			port: 22,
+		},
+		"should ignore port listening on non-loopback address": {
+			data: tcp,
+			port: 8081,
+		},
+		"should detect port listening on ipv6 loopback": {
+			data:     tcp6,
+			port:     8082,
+			ipv6:     true,
+			expected: true,
+		},
+		"should detect port listening on ipv6 unspecified address": {
+			data:     tcp6,
+			port:     8083,
+			ipv6:     true,
+			expected: true,
+		},
+		"should not detect port not listened": {
+			data: tcp6,
+			port: 8080,
+			ipv6: true,
+		},
+	} {
+		t.Logf("TestCase %q", desc)
+		assert.Equal(t, test.expected, isTCPListening([]byte(test.data), test.port, test.ipv6))
+	}
+}
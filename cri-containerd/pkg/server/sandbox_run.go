@@ -272,7 +272,7 @@ func (c *criContainerdService) generateSandboxContainerSpec(id string, config *r
 	// Creates a spec Generator with the default spec.
 	// TODO(random-liu): [P1] Compare the default settings with docker and containerd default.
 	// 创建一个cri-containerd默认的spec
-	spec, err := defaultRuntimeSpec(id)
+	spec, err := defaultRuntimeSpec(c.namespace, id, false)
 	if err != nil {
 		return nil, err
 	}
@@ -387,10 +387,7 @@ func (c *criContainerdService) setupSandboxFiles(rootDir string, config *runtime
 	resolvContent := ""
 	// 将config中的dns config转换为resolvContent
 	if dnsConfig := config.GetDnsConfig(); dnsConfig != nil {
-		resolvContent, err = parseDNSOptions(dnsConfig.Servers, dnsConfig.Searches, dnsConfig.Options)
-		if err != nil {
-			return fmt.Errorf("failed to parse sandbox DNSConfig %+v: %v", dnsConfig, err)
-		}
+		resolvContent = parseDNSOptions(dnsConfig.Servers, dnsConfig.Searches, dnsConfig.Options)
 	}
 	resolvPath := getResolvPath(rootDir)
 	// 如果在配置中指定了dns，即resolvContent不为""，则将其写入resolvPath，否则直接将宿主机的/etc/resolv.conf写入
@@ -430,27 +427,59 @@ func (c *criContainerdService) setupSandboxFiles(rootDir string, config *runtime
 }
 
 // parseDNSOptions parse DNS options into resolv.conf format content,
-// if none option is specified, will return empty with no error.
-func parseDNSOptions(servers, searches, options []string) (string, error) {
+// if none option is specified, will return empty. Duplicated entries are removed
+// keeping the first occurrence, and nameservers and searches exceeding the resolver
+// limits are dropped with a warning, which is the same as kubelet.
+func parseDNSOptions(servers, searches, options []string) string {
 	resolvContent := ""
 
+	searches = dedupStrings(searches)
 	if len(searches) > maxDNSSearches {
-		return "", fmt.Errorf("DNSOption.Searches has more than 6 domains")
+		glog.Warningf("DNS searches %v exceed the limit %d, only the first %d are used",
+			searches, maxDNSSearches, maxDNSSearches)
+		searches = searches[:maxDNSSearches]
+	}
+	if len(strings.Join(searches, " ")) > maxDNSSearchListChars {
+		glog.Warningf("DNS search list %v exceeds the limit of %d characters, it is truncated",
+			searches, maxDNSSearchListChars)
+		for len(strings.Join(searches, " ")) > maxDNSSearchListChars {
+			searches = searches[:len(searches)-1]
+		}
 	}
-
 	if len(searches) > 0 {
 		resolvContent += fmt.Sprintf("search %s\n", strings.Join(searches, " "))
 	}
 
+	servers = dedupStrings(servers)
+	if len(servers) > maxDNSNameservers {
+		glog.Warningf("DNS nameservers %v exceed the limit %d, only the first %d are used",
+			servers, maxDNSNameservers, maxDNSNameservers)
+		servers = servers[:maxDNSNameservers]
+	}
 	if len(servers) > 0 {
 		resolvContent += fmt.Sprintf("nameserver %s\n", strings.Join(servers, "\nnameserver "))
 	}
 
+	options = dedupStrings(options)
 	if len(options) > 0 {
 		resolvContent += fmt.Sprintf("options %s\n", strings.Join(options, " "))
 	}
 
-	return resolvContent, nil
+	return resolvContent
+}
+
+// dedupStrings removes duplicated strings, keeping the order of first occurrences.
+func dedupStrings(strs []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, s := range strs {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		result = append(result, s)
+	}
+	return result
 }
 
 // unmountSandboxFiles unmount some sandbox files, we rely on the removal of sandbox root directory to
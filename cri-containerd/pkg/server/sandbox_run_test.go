@@ -18,6 +18,7 @@ package server
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/containerd/typeurl"
@@ -283,7 +284,6 @@ func TestParseDNSOption(t *testing.T) {
 		searches        []string
 		options         []string
 		expectedContent string
-		expectErr       bool
 	}{
 		"empty dns options should return empty content": {},
 		"non-empty dns options should return correct content": {
@@ -296,7 +296,17 @@ nameserver server.google.com
 options timeout:1
 `,
 		},
-		"should return error if dns search exceeds limit(6)": {
+		"should remove duplicated dns options": {
+			servers:  []string{"8.8.8.8", "8.8.4.4", "8.8.8.8"},
+			searches: []string{"svc.cluster.local", "cluster.local", "svc.cluster.local"},
+			options:  []string{"ndots:5", "ndots:5"},
+			expectedContent: `search svc.cluster.local cluster.local
+nameserver 8.8.8.8
+nameserver 8.8.4.4
+options ndots:5
+`,
+		},
+		"should truncate dns searches exceeding limit(6)": {
 			searches: []string{
 				"server0.google.com",
 				"server1.google.com",
@@ -306,17 +316,28 @@ options timeout:1
 				"server5.google.com",
 				"server6.google.com",
 			},
-			expectErr: true,
+			expectedContent: "search server0.google.com server1.google.com server2.google.com " +
+				"server3.google.com server4.google.com server5.google.com\n",
+		},
+		"should truncate dns search list exceeding 256 characters": {
+			searches: []string{
+				strings.Repeat("a", 100),
+				strings.Repeat("b", 100),
+				strings.Repeat("c", 100),
+			},
+			expectedContent: "search " + strings.Repeat("a", 100) + " " + strings.Repeat("b", 100) + "\n",
+		},
+		"should truncate dns nameservers exceeding limit(3)": {
+			servers: []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"},
+			expectedContent: `nameserver 1.1.1.1
+nameserver 2.2.2.2
+nameserver 3.3.3.3
+`,
 		},
 	} {
 		t.Logf("TestCase %q", desc)
-		resolvContent, err := parseDNSOptions(test.servers, test.searches, test.options)
-		if test.expectErr {
-			assert.Error(t, err)
-			continue
-		}
-		assert.NoError(t, err)
-		assert.Equal(t, resolvContent, test.expectedContent)
+		resolvContent := parseDNSOptions(test.servers, test.searches, test.options)
+		assert.Equal(t, test.expectedContent, resolvContent)
 	}
 }
 
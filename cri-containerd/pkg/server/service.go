@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	goruntime "runtime"
 	"syscall"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/containerd/containerd/api/services/tasks/v1"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/plugin"
 	"github.com/containerd/containerd/sys"
 	"github.com/cri-o/ocicni/pkg/ocicni"
@@ -38,7 +40,6 @@ import (
 	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
-	"k8s.io/kubernetes/pkg/kubelet/server/streaming"
 
 	"github.com/kubernetes-incubator/cri-containerd/cmd/cri-containerd/options"
 	api "github.com/kubernetes-incubator/cri-containerd/pkg/api/v1"
@@ -51,8 +52,11 @@ import (
 )
 
 const (
-	// k8sContainerdNamespace is the namespace we use to connect containerd.
+	// k8sContainerdNamespace is the default namespace we use to connect containerd.
 	k8sContainerdNamespace = "k8s.io"
+	// defaultCreatesPerCPU is the default number of concurrent CreateContainer heavy
+	// operations per CPU.
+	defaultCreatesPerCPU = 2
 	// unixProtocol is the network protocol of unix socket.
 	unixProtocol = "unix"
 )
@@ -71,12 +75,32 @@ type CRIContainerdService interface {
 type criContainerdService struct {
 	// config contains all configurations.
 	config options.Config
+	// namespace is the containerd namespace of all containerd resources.
+	namespace string
+	// createLimiter limits the concurrent heavy operations of CreateContainer, e.g.
+	// snapshot and mount preparation. No limit if it is nil.
+	createLimiter chan struct{}
 	// imageFSUUID is the device uuid of image filesystem.
 	imageFSUUID string
 	// apparmorEnabled indicates whether apparmor is enabled.
 	apparmorEnabled bool
 	// seccompEnabled indicates whether seccomp is enabled.
 	seccompEnabled bool
+	// cgroupV2 indicates whether the host is running with cgroup v2 unified hierarchy.
+	cgroupV2 bool
+	// cgroupWritable checks whether a cgroup directory is writable. The check is
+	// skipped if it is nil.
+	cgroupWritable func(string) error
+	// mountInfo loads the mount table of the host, which is parsed at most once per
+	// container creation for mount propagation checks. c.os.LookupMount is used if
+	// it is nil.
+	mountInfo func() ([]mount.Info, error)
+	// procMountOptionsV2 indicates whether the kernel supports the procfs mount options
+	// added in linux 5.8.
+	procMountOptionsV2 bool
+	// detachKeys is the key sequence to detach from an attach session. Detaching
+	// is disabled if it is empty.
+	detachKeys []byte
 	// server is the grpc server.
 	server *grpc.Server
 	// os is an interface for all required os operations.
@@ -115,7 +139,7 @@ type criContainerdService struct {
 	// *****client是containerd的client****
 	client *containerd.Client
 	// streamServer is the streaming server serves container streaming request.
-	streamServer streaming.Server
+	streamServer *streamServer
 	// eventMonitor is the monitor monitors containerd events.
 	// eventMonitor用于监听所有来自containerd的event
 	eventMonitor *eventMonitor
@@ -123,10 +147,19 @@ type criContainerdService struct {
 
 // NewCRIContainerdService returns a new instance of CRIContainerdService
 func NewCRIContainerdService(config options.Config) (CRIContainerdService, error) {
+	if dir := config.DefaultWorkingDir; dir != "" && !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("default working directory %q is not an absolute path", dir)
+	}
 	// 启动containerd client，用于与containerd进行交互
 	// WithDefaultNamespace设置containerd client默认的namespace，如果没有额外设置，则默认都使用该namespace
 	// config.ContainerdConfig.Endpoint默认为"/run/containerd/containerd.sock"
-	client, err := containerd.New(config.ContainerdConfig.Endpoint, containerd.WithDefaultNamespace(k8sContainerdNamespace))
+	// The namespace is configurable, so that several cri-containerd instances could
+	// share one containerd without container id collisions.
+	namespace := config.ContainerdConfig.Namespace
+	if namespace == "" {
+		namespace = k8sContainerdNamespace
+	}
+	client, err := containerd.New(config.ContainerdConfig.Endpoint, containerd.WithDefaultNamespace(namespace))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize containerd client with endpoint %q: %v",
 			config.ContainerdConfig.Endpoint, err)
@@ -148,8 +181,13 @@ func NewCRIContainerdService(config options.Config) (CRIContainerdService, error
 
 	c := &criContainerdService{
 		config:              config,
+		namespace:           namespace,
 		apparmorEnabled:     runcapparmor.IsEnabled(),
 		seccompEnabled:      runcseccomp.IsEnabled(),
+		cgroupV2:            isCgroupV2(),
+		cgroupWritable:      func(p string) error { return unix.Access(p, unix.W_OK) },
+		procMountOptionsV2:  isProcMountOptionsV2Supported(),
+		mountInfo:           mount.Self,
 		os:                  osinterface.RealOS{},
 		// 构建sandbox，container，image，snapshot四个store
 		sandboxStore:        sandboxstore.NewStore(),
@@ -165,6 +203,21 @@ func NewCRIContainerdService(config options.Config) (CRIContainerdService, error
 		client:              client,
 	}
 
+	// Limit concurrent creates to a multiple of the CPU count by default, a negative
+	// limit disables it.
+	maxCreates := config.MaxConcurrentCreates
+	if maxCreates == 0 {
+		maxCreates = defaultCreatesPerCPU * goruntime.NumCPU()
+	}
+	if maxCreates > 0 {
+		c.createLimiter = make(chan struct{}, maxCreates)
+	}
+
+	c.detachKeys, err = parseDetachKeys(config.DetachKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid detach keys %q: %v", config.DetachKeys, err)
+	}
+
 	// RootDir默认是"/var/lib/containerd",Snapshotter默认是"overlayfs"
 	// 本函数仅仅返回"/var/lib/containerd/io.containerd.snapshotter.v1/overlayfs"这一路径信息
 	imageFSPath := imageFSPath(config.ContainerdConfig.RootDir, config.ContainerdConfig.Snapshotter)
@@ -182,7 +235,8 @@ func NewCRIContainerdService(config options.Config) (CRIContainerdService, error
 
 	// prepare streaming server
 	// 创建stream server
-	c.streamServer, err = newStreamServer(c, config.StreamServerAddress, config.StreamServerPort)
+	c.streamServer, err = newStreamServer(c, config.StreamServerAddress, config.StreamServerPort,
+		config.MaxConcurrentStreams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stream server: %v", err)
 	}
@@ -239,6 +293,12 @@ func (c *criContainerdService) Run() error {
 		}
 		close(streamServerCloseCh)
 	}()
+	// Wait for the streaming server to listen before serving grpc requests, so that
+	// the returned streaming urls are reachable. Failure is handled below.
+	select {
+	case <-c.streamServer.Ready():
+	case <-streamServerCloseCh:
+	}
 
 	// Start grpc server.
 	// Unlink to cleanup the previous socket file.
@@ -17,10 +17,12 @@ limitations under the License.
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"net/http"
 
 	"golang.org/x/net/context"
 	k8snet "k8s.io/apimachinery/pkg/util/net"
@@ -30,7 +32,9 @@ import (
 	"k8s.io/utils/exec"
 )
 
-func newStreamServer(c *criContainerdService, addr, port string) (streaming.Server, error) {
+// newStreamServer creates the streaming server. maxStreams limits the number of
+// concurrent exec, attach and port forward sessions, 0 means unlimited.
+func newStreamServer(c *criContainerdService, addr, port string, maxStreams int) (*streamServer, error) {
 	if addr == "" {
 		a, err := k8snet.ChooseBindAddress(nil)
 		if err != nil {
@@ -43,7 +47,95 @@ func newStreamServer(c *criContainerdService, addr, port string) (streaming.Serv
 	config.Addr = net.JoinHostPort(addr, port)
 	// runtime实现了streaming server指定的Exec,Attach和PortForward三个方法
 	runtime := newStreamRuntime(c)
-	return streaming.NewServer(config, runtime)
+	server, err := streaming.NewServer(config, runtime)
+	if err != nil {
+		return nil, err
+	}
+	return &streamServer{
+		Server: server,
+		server: &http.Server{Addr: config.Addr, Handler: newStreamLimitHandler(server, maxStreams)},
+		ready:  make(chan struct{}),
+	}, nil
+}
+
+// streamServer wraps the streaming server to serve on its own listener, so that
+// readiness could be signaled once the listener is bound.
+type streamServer struct {
+	streaming.Server
+	server *http.Server
+	ready  chan struct{}
+}
+
+// Ready returns a channel which is closed once the streaming server is listening.
+func (s *streamServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Start binds the listener, signals readiness and serves streaming requests.
+func (s *streamServer) Start(stayUp bool) error {
+	if !stayUp {
+		return errors.New("stayUp=false is not yet implemented")
+	}
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", s.server.Addr, err)
+	}
+	close(s.ready)
+	return s.server.Serve(l)
+}
+
+// Stop stops the streaming server.
+func (s *streamServer) Stop() error {
+	return s.server.Close()
+}
+
+// errTooManyStreams is the error returned when the concurrent streaming session
+// limit is reached.
+var errTooManyStreams = errors.New("too many concurrent streaming sessions, try again later")
+
+// streamLimitHandler limits the concurrent streaming sessions served by the
+// wrapped handler. The limit is checked before the connection is upgraded, so
+// that the client gets an http error instead of a broken stream.
+type streamLimitHandler struct {
+	handler http.Handler
+	// sessions is a semaphore limiting concurrent streaming sessions, nil
+	// if unlimited.
+	sessions chan struct{}
+}
+
+func newStreamLimitHandler(handler http.Handler, maxStreams int) http.Handler {
+	h := &streamLimitHandler{handler: handler}
+	if maxStreams > 0 {
+		h.sessions = make(chan struct{}, maxStreams)
+	}
+	return h
+}
+
+// acquire reserves a streaming session, errTooManyStreams is returned if the limit
+// is reached. The returned release function must be called when the session ends.
+func (h *streamLimitHandler) acquire() (func(), error) {
+	if h.sessions == nil {
+		return func() {}, nil
+	}
+	select {
+	case h.sessions <- struct{}{}:
+		return func() { <-h.sessions }, nil
+	default:
+		return nil, errTooManyStreams
+	}
+}
+
+// ServeHTTP serves the request with the wrapped handler, which returns when the
+// streaming session ends, or replies http.StatusTooManyRequests if the limit is
+// reached.
+func (h *streamLimitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	release, err := h.acquire()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+	h.handler.ServeHTTP(w, req)
 }
 
 type streamRuntime struct {
@@ -81,7 +173,7 @@ func (s *streamRuntime) Exec(containerID string, cmd []string, stdin io.Reader,
 
 func (s *streamRuntime) Attach(containerID string, in io.Reader, out, err io.WriteCloser, tty bool,
 	resize <-chan remotecommand.TerminalSize) error {
-	return s.c.attachContainer(context.Background(), containerID, in, out, err, tty, resize)
+	return s.c.attachContainer(context.Background(), containerID, in, out, err, tty, resize, s.c.detachKeys)
 }
 
 func (s *streamRuntime) PortForward(podSandboxID string, port int32, stream io.ReadWriteCloser) error {
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamSessionLimit(t *testing.T) {
+	release := make(chan struct{})
+	served := make(chan struct{}, 3)
+	// The fake streaming handler returns when the session ends.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		served <- struct{}{}
+		<-release
+	})
+	h := newStreamLimitHandler(handler, 2)
+	codes := make(chan int, 3)
+	serve := func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/exec/token", nil))
+		codes <- w.Code
+	}
+
+	go serve()
+	go serve()
+	<-served
+	<-served
+	serve()
+	assert.Equal(t, http.StatusTooManyRequests, <-codes, "should reject session over the limit")
+
+	release <- struct{}{}
+	assert.Equal(t, http.StatusOK, <-codes)
+	go serve()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Fatal("should accept session after one ends")
+	}
+	close(release)
+	assert.Equal(t, http.StatusOK, <-codes)
+	assert.Equal(t, http.StatusOK, <-codes)
+
+	unlimited := newStreamLimitHandler(http.NotFoundHandler(), 0).(*streamLimitHandler)
+	for i := 0; i < 10; i++ {
+		_, err := unlimited.acquire()
+		assert.NoError(t, err)
+	}
+}
+
+func TestStreamServerReady(t *testing.T) {
+	c := newTestCRIContainerdService()
+	s, err := newStreamServer(c, "127.0.0.1", "0", 0)
+	require.NoError(t, err)
+	select {
+	case <-s.Ready():
+		t.Fatal("stream server should not be ready before started")
+	default:
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Start(true) }()
+	select {
+	case <-s.Ready():
+	case err := <-errCh:
+		t.Fatalf("stream server exits before ready: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for stream server to be ready")
+	}
+
+	require.NoError(t, s.Stop())
+	assert.Equal(t, http.ErrServerClosed, <-errCh)
+}
@@ -15,6 +15,7 @@
 package backend
 
 import (
+	"encoding/json"
 	"net"
 
 	"golang.org/x/net/context"
@@ -45,6 +46,10 @@ type Network interface {
 
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
 
+// BackendConfigCtor is a backend constructor which also receives the backend
+// specific config blob passed to GetBackendWithConfig, which could be nil.
+type BackendConfigCtor func(sm subnet.Manager, ei *ExternalInterface, config json.RawMessage) (Backend, error)
+
 type SimpleNetwork struct {
 	SubnetLease *subnet.Lease
 	ExtIface    *ExternalInterface
@@ -15,83 +15,544 @@
 package backend
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/subnet"
 )
 
 // 每个backend包都会在init函数中调用Register函数进行注册
-var constructors = make(map[string]BackendCtor)
+var constructors = make(map[string]BackendConfigCtor)
+
+// candidates are the backends registered with a priority for auto-selection.
+var candidates = make(map[string]candidate)
+
+// candidate is a backend which could be auto-selected.
+type candidate struct {
+	priority int
+	// probe returns an error if the backend can't work on the host, e.g. the
+	// kernel lacks the required module.
+	probe func() error
+}
+
+// aliases maps alternative spellings of backend types to the canonical names.
+var aliases = map[string]string{
+	"hostgw":  "host-gw",
+	"host_gw": "host-gw",
+}
 
 type Manager interface {
 	GetBackend(backendType string) (Backend, error)
+	// GetBackendWithConfig is like GetBackend, but passes the backend specific
+	// config to the constructor. The config is ignored if the backend is
+	// already running.
+	GetBackendWithConfig(backendType string, config json.RawMessage) (Backend, error)
+	// Shutdown stops all backends, and blocks until they, their networks and the
+	// backends being created are stopped, or ctx is done, in which case an error
+	// is returned.
+	Shutdown(ctx context.Context) error
+	// ActiveBackends returns the sorted names of the running backends.
+	ActiveBackends() []string
+	// Stats returns a snapshot of the manager counters.
+	Stats() Stats
+	// RunNetwork runs the network of the backend until ctx is done or the manager
+	// is shut down. If Run exits earlier, e.g. the backend device was deleted, the
+	// backend is removed from the active backends, so that the next GetBackend
+	// creates a fresh one. Shutdown waits for RunNetwork to return.
+	RunNetwork(ctx context.Context, backendType string, nw Network)
+	// WaitReady blocks until the running backend has finished its initial setup,
+	// or ctx is done, in which case an error is returned. A backend still under
+	// construction is waited for to be created first. Backends not
+	// implementing ReadyNotifier are ready once created.
+	WaitReady(ctx context.Context, backendType string) error
+	// SelectBackend returns the backend type with the highest priority whose
+	// probe succeeds, among the backends registered with RegisterWithPriority.
+	SelectBackend() (string, error)
+}
+
+// ConfigChangeNotifier is optionally implemented by backends which need to react
+// to network config changes, e.g. to reprogram routes. The manager polls the
+// network config of the subnet manager every configWatchInterval and notifies the
+// running backends, so that they don't need to poll independently. Subnet lease
+// changes are not observed, backends reacting to them still need to watch the
+// leases with the subnet manager.
+type ConfigChangeNotifier interface {
+	// OnConfigChanged is called with the new network config when it changes.
+	OnConfigChanged(ctx context.Context, config *subnet.Config)
+}
+
+// configWatchInterval is the interval to check the network config for changes.
+var configWatchInterval = time.Minute
+
+// ReadyNotifier is optionally implemented by backends which need to finish
+// their initial setup, e.g. creating the device and installing routes, before
+// traffic is routed to them.
+type ReadyNotifier interface {
+	// Ready returns a channel which is closed once the backend is ready.
+	Ready() <-chan struct{}
+}
+
+// Closer is optionally implemented by backends which hold resources once created,
+// e.g. a device. Close is called if the backend is discarded because the manager
+// was shut down while it was being created.
+type Closer interface {
+	Close() error
+}
+
+// errShuttingDown is returned when the backend manager is shut down.
+var errShuttingDown = errors.New("backend manager is shutting down")
+
+// networkError is optionally implemented by networks to report why Run exited.
+type networkError interface {
+	Err() error
+}
+
+// Stats is a snapshot of the backend manager counters.
+type Stats struct {
+	// Requests is the number of times each backend type was requested.
+	Requests map[string]uint64
+	// Active is the number of running backends.
+	Active int
+	// Errors is the number of backends failed to be created.
+	Errors uint64
+	// TeardownRaces is the number of teardowns finding the backend already removed.
+	TeardownRaces uint64
+	// Crashes is the number of backend networks exited before shutdown.
+	Crashes uint64
+}
+
+// backendInitTimeout is the max time GetBackend waits for the backend construction.
+var backendInitTimeout = time.Minute
+
+// pendingBackend is a backend under construction. Other callers requesting the
+// same backend wait for it instead of constructing another one.
+type pendingBackend struct {
+	// done is closed once the construction finishes.
+	done chan struct{}
+	be   Backend
+	err  error
 }
 
 type manager struct {
 	ctx      context.Context
+	cancel   context.CancelFunc
 	sm       subnet.Manager
 	extIface *ExternalInterface
 	mux      sync.Mutex
 	active   map[string]Backend
 	wg       sync.WaitGroup
+	// watchOnce starts the network config watch when the first backend is created.
+	watchOnce sync.Once
+	// pending are the backends under construction.
+	pending map[string]*pendingBackend
+	// generations is incremented each time a backend is created, so that
+	// stale teardowns don't remove the recreated backend.
+	generations map[string]uint64
+	// stops are closed when the active backends are removed, to stop their
+	// teardowns waiting for shutdown.
+	stops map[string]chan struct{}
+
+	// counters protected by mux
+	requests      map[string]uint64
+	errors        uint64
+	teardownRaces uint64
+	crashes       uint64
 }
 
 func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface) Manager {
+	ctx, cancel := context.WithCancel(ctx)
 	return &manager{
-		ctx:      ctx,
-		sm:       sm,
-		extIface: extIface,
-		active:   make(map[string]Backend),
+		ctx:         ctx,
+		cancel:      cancel,
+		sm:          sm,
+		extIface:    extIface,
+		active:      make(map[string]Backend),
+		pending:     make(map[string]*pendingBackend),
+		generations: make(map[string]uint64),
+		stops:       make(map[string]chan struct{}),
+		requests:    make(map[string]uint64),
 	}
 }
 
 func (bm *manager) GetBackend(backendType string) (Backend, error) {
-	bm.mux.Lock()
-	defer bm.mux.Unlock()
+	return bm.GetBackendWithConfig(backendType, nil)
+}
 
-	betype := strings.ToLower(backendType)
+func (bm *manager) GetBackendWithConfig(backendType string, config json.RawMessage) (Backend, error) {
+	bm.mux.Lock()
+	betype := canonicalType(backendType)
+	bm.requests[betype]++
+	if bm.ctx.Err() != nil {
+		bm.mux.Unlock()
+		return nil, errShuttingDown
+	}
 	// see if one is already running
 	if be, ok := bm.active[betype]; ok {
+		bm.mux.Unlock()
 		return be, nil
 	}
+	// see if one is being created by another caller
+	if p, ok := bm.pending[betype]; ok {
+		bm.mux.Unlock()
+		return bm.waitPending(betype, p)
+	}
 
 	// first request, need to create and run it
 	// 根据backend类型获取对应的初始化函数
 	befunc, ok := constructors[betype]
 	if !ok {
+		bm.errors++
+		bm.mux.Unlock()
 		return nil, fmt.Errorf("unknown backend type: %v", betype)
 	}
 
-	// 初始化backend
-	be, err := befunc(bm.sm, bm.extIface)
+	// Reserve the slot and construct the backend without holding mux, so that a
+	// blocking constructor doesn't stall the callers of other backends.
+	// Shutdown waits for the construction.
+	p := &pendingBackend{done: make(chan struct{})}
+	bm.pending[betype] = p
+	bm.wg.Add(1)
+	bm.mux.Unlock()
+
+	go func() {
+		defer bm.wg.Done()
+		// 初始化backend
+		be, err := befunc(bm.sm, bm.extIface, config)
+		if bm.finalize(betype, p, be, err) {
+			return
+		}
+		// The manager was shut down during the construction, release what the
+		// backend holds as it will never run.
+		if c, ok := be.(Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Warningf("Failed to close discarded backend %q: %v", betype, err)
+			}
+		}
+	}()
+	return bm.waitPending(betype, p)
+}
+
+// waitPending waits for the backend under construction, until backendInitTimeout
+// or the manager is shut down. The construction goes on after the timeout, and
+// the backend becomes active if it succeeds eventually.
+func (bm *manager) waitPending(betype string, p *pendingBackend) (Backend, error) {
+	timer := time.NewTimer(backendInitTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return p.be, p.err
+	case <-bm.ctx.Done():
+		return nil, errShuttingDown
+	case <-timer.C:
+		bm.mux.Lock()
+		bm.errors++
+		bm.mux.Unlock()
+		return nil, fmt.Errorf("timed out waiting for backend %q to be created", betype)
+	}
+}
+
+// finalize records the result of the backend construction, activates the
+// backend on success and wakes up the waiting callers. It returns false if
+// the backend is created but discarded because the manager is shut down.
+func (bm *manager) finalize(betype string, p *pendingBackend, be Backend, err error) bool {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+	defer close(p.done)
+
+	delete(bm.pending, betype)
 	if err != nil {
-		return nil, err
+		bm.errors++
+		p.err = err
+		return true
 	}
+	if bm.ctx.Err() != nil {
+		p.err = errShuttingDown
+		return false
+	}
+	p.be = be
 	bm.active[betype] = be
+	bm.generations[betype]++
+	gen := bm.generations[betype]
+	stop := make(chan struct{})
+	bm.stops[betype] = stop
+	bm.watchOnce.Do(func() {
+		bm.wg.Add(1)
+		go func() {
+			defer bm.wg.Done()
+			bm.watchConfig()
+		}()
+	})
 
 	bm.wg.Add(1)
 	go func() {
-		<-bm.ctx.Done()
+		defer bm.wg.Done()
+		select {
+		case <-bm.ctx.Done():
+		case <-stop:
+			// Already removed, e.g. the network crashed.
+			return
+		}
+
+		bm.mux.Lock()
+		defer bm.mux.Unlock()
+		// The backend could still be removed in between by a network crashing
+		// at the same time as shutdown.
+		if !bm.remove(betype, gen) {
+			bm.teardownRaces++
+		}
+	}()
+	return true
+}
 
-		// TODO(eyakubovich): this obviosly introduces a race.
-		// GetBackend() could get called while we are here.
-		// Currently though, all backends' Run exit only
-		// on shutdown
+func (bm *manager) RunNetwork(ctx context.Context, backendType string, nw Network) {
+	betype := canonicalType(backendType)
+	bm.mux.Lock()
+	// Shutdown cancels with mux held, so the network is not added to wg
+	// once Shutdown is waiting.
+	if bm.ctx.Err() != nil {
+		bm.mux.Unlock()
+		return
+	}
+	bm.wg.Add(1)
+	defer bm.wg.Done()
+	gen := bm.generations[betype]
+	bm.mux.Unlock()
+
+	// Stop the network on shutdown as well.
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-bm.ctx.Done():
+			cancel()
+		case <-runCtx.Done():
+		}
+	}()
+	nw.Run(runCtx)
+	if ctx.Err() != nil || bm.ctx.Err() != nil {
+		return
+	}
+
+	var err error
+	if e, ok := nw.(networkError); ok {
+		err = e.Err()
+	}
+	log.Errorf("Network of backend %q exited unexpectedly: %v", betype, err)
+
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+	bm.crashes++
+	bm.remove(betype, gen)
+}
+
+func (bm *manager) WaitReady(ctx context.Context, backendType string) error {
+	betype := canonicalType(backendType)
+	bm.mux.Lock()
+	be, ok := bm.active[betype]
+	p, pending := bm.pending[betype]
+	bm.mux.Unlock()
+	if !ok {
+		if !pending {
+			return fmt.Errorf("backend %q is not running", betype)
+		}
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for backend %q to be created: %v", betype, ctx.Err())
+		case <-bm.ctx.Done():
+			return errShuttingDown
+		}
+		if p.err != nil {
+			return p.err
+		}
+		be = p.be
+	}
+
+	rn, ok := be.(ReadyNotifier)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-rn.Ready():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for backend %q to be ready: %v", betype, ctx.Err())
+	case <-bm.ctx.Done():
+		return errShuttingDown
+	}
+}
+
+func (bm *manager) SelectBackend() (string, error) {
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		names = append(names, name)
+	}
+	// Sort by priority, and by name for the same priority to be deterministic.
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := candidates[names[i]].priority, candidates[names[j]].priority
+		if pi != pj {
+			return pi > pj
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		if probe := candidates[name].probe; probe != nil {
+			if err := probe(); err != nil {
+				log.Warningf("Backend %q is unavailable: %v", name, err)
+				continue
+			}
+		}
+		log.Infof("Selected backend %q with priority %d", name, candidates[name].priority)
+		return name, nil
+	}
+	return "", fmt.Errorf("no available backend among %v", names)
+}
+
+// watchConfig polls the network config until the manager is shut down, and
+// notifies the running backends implementing ConfigChangeNotifier on change.
+func (bm *manager) watchConfig() {
+	last, err := bm.sm.GetNetworkConfig(bm.ctx)
+	if err != nil {
+		log.Warningf("Failed to get network config: %v", err)
+	}
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bm.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		config, err := bm.sm.GetNetworkConfig(bm.ctx)
+		if err != nil {
+			log.Warningf("Failed to get network config: %v", err)
+			continue
+		}
+		if last == nil || reflect.DeepEqual(last, config) {
+			last = config
+			continue
+		}
+		last = config
+		log.Infof("Network config changed, notifying backends")
 
 		bm.mux.Lock()
-		delete(bm.active, betype)
+		var notifiers []ConfigChangeNotifier
+		for _, be := range bm.active {
+			if n, ok := be.(ConfigChangeNotifier); ok {
+				notifiers = append(notifiers, n)
+			}
+		}
 		bm.mux.Unlock()
+		// Notify without holding mux, so that backends can call into the manager.
+		for _, n := range notifiers {
+			n.OnConfigChanged(bm.ctx, config)
+		}
+	}
+}
 
-		bm.wg.Done()
+// remove removes the backend from active if it is still the same generation,
+// and stops its teardown. It returns false if the backend has already been
+// removed or recreated. The caller must hold mux.
+func (bm *manager) remove(betype string, gen uint64) bool {
+	if _, ok := bm.active[betype]; !ok || bm.generations[betype] != gen {
+		return false
+	}
+	delete(bm.active, betype)
+	close(bm.stops[betype])
+	delete(bm.stops, betype)
+	return true
+}
+
+func (bm *manager) Shutdown(ctx context.Context) error {
+	bm.mux.Lock()
+	bm.cancel()
+	bm.mux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		bm.wg.Wait()
+		close(done)
 	}()
 
-	return be, nil
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for backends to stop: %v", ctx.Err())
+	}
+}
+
+func (bm *manager) ActiveBackends() []string {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	names := make([]string, 0, len(bm.active))
+	for name := range bm.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (bm *manager) Stats() Stats {
+	bm.mux.Lock()
+	defer bm.mux.Unlock()
+
+	requests := make(map[string]uint64, len(bm.requests))
+	for name, n := range bm.requests {
+		requests[name] = n
+	}
+	return Stats{
+		Requests:      requests,
+		Active:        len(bm.active),
+		Errors:        bm.errors,
+		TeardownRaces: bm.teardownRaces,
+		Crashes:       bm.crashes,
+	}
 }
 
 func Register(name string, ctor BackendCtor) {
+	RegisterWithConfig(name, func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		return ctor(sm, ei)
+	})
+}
+
+// RegisterWithConfig registers a backend constructor which receives the backend
+// specific config.
+func RegisterWithConfig(name string, ctor BackendConfigCtor) {
 	constructors[name] = ctor
 }
+
+// RegisterWithPriority registers a backend constructor which is also a candidate
+// for SelectBackend. Backends with higher priority are preferred, and probe, if
+// not nil, checks whether the backend can work on the host.
+func RegisterWithPriority(name string, ctor BackendConfigCtor, priority int, probe func() error) {
+	RegisterWithConfig(name, ctor)
+	candidates[name] = candidate{priority: priority, probe: probe}
+}
+
+// canonicalType returns the canonical lower case name of the backend type.
+func canonicalType(backendType string) string {
+	betype := strings.ToLower(backendType)
+	if canonical, ok := aliases[betype]; ok {
+		return canonical
+	}
+	return betype
+}
+
+// RegisterAlias registers an alternative name for the backend type, which is
+// resolved to the canonical name in GetBackend.
+func RegisterAlias(alias, canonical string) {
+	aliases[strings.ToLower(alias)] = canonical
+}
@@ -0,0 +1,593 @@
+// Copyright 2015 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// fakeSubnetManager only serves the network config for the config watch.
+type fakeSubnetManager struct {
+	subnet.Manager
+}
+
+func (*fakeSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	return &subnet.Config{}, nil
+}
+
+// configSubnetManager serves a network config which could be changed.
+type configSubnetManager struct {
+	subnet.Manager
+	mu     sync.Mutex
+	config *subnet.Config
+}
+
+func (m *configSubnetManager) GetNetworkConfig(ctx context.Context) (*subnet.Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config, nil
+}
+
+func (m *configSubnetManager) setConfig(config *subnet.Config) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = config
+}
+
+type fakeBackend struct{}
+
+func (*fakeBackend) RegisterNetwork(ctx context.Context, config *subnet.Config) (Network, error) {
+	return newFakeNetwork(), nil
+}
+
+// fakeNetwork runs until ctx is done or exit is closed.
+type fakeNetwork struct {
+	started chan struct{}
+	exit    chan struct{}
+	stopped chan struct{}
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		started: make(chan struct{}),
+		exit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (*fakeNetwork) Lease() *subnet.Lease { return nil }
+
+func (*fakeNetwork) MTU() int { return 1500 }
+
+func (n *fakeNetwork) Run(ctx context.Context) {
+	defer close(n.stopped)
+	close(n.started)
+	select {
+	case <-ctx.Done():
+	case <-n.exit:
+	}
+}
+
+// registerFakeBackend registers a backend type counting the constructions.
+func registerFakeBackend(name string) *int {
+	created := new(int)
+	RegisterWithConfig(name, func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		*created++
+		return &fakeBackend{}, nil
+	})
+	return created
+}
+
+func waitClosed(t *testing.T, ch <-chan struct{}, msg string) {
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal(msg)
+	}
+}
+
+func TestShutdownWaitsForNetworks(t *testing.T) {
+	registerFakeBackend("fake-shutdown")
+	bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+	if _, err := bm.GetBackend("fake-shutdown"); err != nil {
+		t.Fatalf("failed to get backend: %v", err)
+	}
+	nw := newFakeNetwork()
+	go bm.RunNetwork(context.Background(), "fake-shutdown", nw)
+	waitClosed(t, nw.started, "network should be started")
+
+	if err := bm.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	select {
+	case <-nw.stopped:
+	default:
+		t.Error("Shutdown should wait for the network to stop")
+	}
+	if active := bm.ActiveBackends(); len(active) != 0 {
+		t.Errorf("expected no active backends after shutdown, got %v", active)
+	}
+}
+
+func TestCrashedNetworkRecreated(t *testing.T) {
+	created := registerFakeBackend("fake-crash")
+	bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+	if _, err := bm.GetBackend("fake-crash"); err != nil {
+		t.Fatalf("failed to get backend: %v", err)
+	}
+	nw := newFakeNetwork()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bm.RunNetwork(context.Background(), "fake-crash", nw)
+	}()
+	waitClosed(t, nw.started, "network should be started")
+	close(nw.exit)
+	waitClosed(t, done, "RunNetwork should return once the network exits")
+
+	if active := bm.ActiveBackends(); len(active) != 0 {
+		t.Errorf("expected crashed backend to be removed, got %v", active)
+	}
+	if _, err := bm.GetBackend("fake-crash"); err != nil {
+		t.Fatalf("failed to get backend after crash: %v", err)
+	}
+	if *created != 2 {
+		t.Errorf("expected a fresh backend after crash, created %d", *created)
+	}
+
+	if err := bm.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	stats := bm.Stats()
+	if stats.Crashes != 1 {
+		t.Errorf("expected 1 crash, got %d", stats.Crashes)
+	}
+	if stats.TeardownRaces != 0 {
+		t.Errorf("expected no teardown race, got %d", stats.TeardownRaces)
+	}
+}
+
+// closingBackend records whether it was closed.
+type closingBackend struct {
+	fakeBackend
+	closed chan struct{}
+}
+
+func (b *closingBackend) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestBlockingConstructor(t *testing.T) {
+	registerFakeBackend("fake-other")
+	entered, unblock := make(chan struct{}), make(chan struct{})
+	blocked := &closingBackend{closed: make(chan struct{})}
+	RegisterWithConfig("fake-blocking", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		close(entered)
+		<-unblock
+		return blocked, nil
+	})
+	bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+
+	getErr := make(chan error, 1)
+	go func() {
+		_, err := bm.GetBackend("fake-blocking")
+		getErr <- err
+	}()
+	waitClosed(t, entered, "constructor should be called")
+
+	other := make(chan struct{})
+	go func() {
+		defer close(other)
+		if _, err := bm.GetBackend("fake-other"); err != nil {
+			t.Errorf("failed to get other backend: %v", err)
+		}
+	}()
+	waitClosed(t, other, "blocking constructor should not stall other backend types")
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		if err := bm.Shutdown(context.Background()); err != nil {
+			t.Errorf("failed to shut down: %v", err)
+		}
+	}()
+	select {
+	case err := <-getErr:
+		if err != errShuttingDown {
+			t.Errorf("expected shutdown error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("waiting caller should return on shutdown")
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown should wait for the pending constructor")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	waitClosed(t, shutdown, "Shutdown should return once the constructor returns")
+	select {
+	case <-blocked.closed:
+	default:
+		t.Error("backend created after shutdown should be closed")
+	}
+	if active := bm.ActiveBackends(); len(active) != 0 {
+		t.Errorf("expected no active backends after shutdown, got %v", active)
+	}
+}
+
+// notifierBackend forwards the config changes it is notified of.
+type notifierBackend struct {
+	fakeBackend
+	changes chan *subnet.Config
+}
+
+func (b *notifierBackend) OnConfigChanged(ctx context.Context, config *subnet.Config) {
+	b.changes <- config
+}
+
+func TestConfigChangeNotified(t *testing.T) {
+	interval := configWatchInterval
+	configWatchInterval = 10 * time.Millisecond
+	defer func() { configWatchInterval = interval }()
+
+	be := &notifierBackend{changes: make(chan *subnet.Config, 10)}
+	RegisterWithConfig("fake-notifier", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		return be, nil
+	})
+	sm := &configSubnetManager{config: &subnet.Config{SubnetLen: 24}}
+	bm := NewManager(context.Background(), sm, nil)
+	defer bm.Shutdown(context.Background()) // nolint: errcheck
+	if _, err := bm.GetBackend("fake-notifier"); err != nil {
+		t.Fatalf("failed to get backend: %v", err)
+	}
+
+	// Let the watch load the initial config, which should not be notified.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case config := <-be.changes:
+		t.Fatalf("unexpected notification of unchanged config %+v", config)
+	default:
+	}
+
+	sm.setConfig(&subnet.Config{SubnetLen: 26})
+	select {
+	case config := <-be.changes:
+		if config.SubnetLen != 26 {
+			t.Errorf("expected the changed config, got %+v", config)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("changed config should be notified to the backend")
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	saved := candidates
+	defer func() { candidates = saved }()
+
+	available := func() error { return nil }
+	unavailable := func() error { return errors.New("not supported") }
+	for desc, test := range map[string]struct {
+		candidates map[string]candidate
+		expected   string
+		expectErr  bool
+	}{
+		"higher priority should be selected": {
+			candidates: map[string]candidate{
+				"low":  {priority: 1, probe: available},
+				"high": {priority: 10, probe: available},
+				"mid":  {priority: 5},
+			},
+			expected: "high",
+		},
+		"failed probe should fall back to the next priority": {
+			candidates: map[string]candidate{
+				"low":  {priority: 1, probe: available},
+				"high": {priority: 10, probe: unavailable},
+				"mid":  {priority: 5, probe: available},
+			},
+			expected: "mid",
+		},
+		"same priority should be selected by name": {
+			candidates: map[string]candidate{
+				"b": {priority: 5},
+				"c": {priority: 5},
+				"a": {priority: 5},
+			},
+			expected: "a",
+		},
+		"should fail when all probes fail": {
+			candidates: map[string]candidate{
+				"a": {priority: 5, probe: unavailable},
+				"b": {priority: 1, probe: unavailable},
+			},
+			expectErr: true,
+		},
+		"should fail without candidates": {
+			candidates: map[string]candidate{},
+			expectErr:  true,
+		},
+	} {
+		candidates = test.candidates
+		bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+		name, err := bm.SelectBackend()
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got backend %q", desc, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", desc, err)
+			continue
+		}
+		if name != test.expected {
+			t.Errorf("%s: expected backend %q, got %q", desc, test.expected, name)
+		}
+	}
+}
+
+func TestCanonicalType(t *testing.T) {
+	RegisterAlias("Fake-Alias", "fake-canonical")
+	defer delete(aliases, "fake-alias")
+
+	for desc, test := range map[string]struct {
+		backendType string
+		expected    string
+	}{
+		"canonical name should be unchanged": {
+			backendType: "vxlan",
+			expected:    "vxlan",
+		},
+		"name should be lower cased": {
+			backendType: "VXLAN",
+			expected:    "vxlan",
+		},
+		"builtin alias should be resolved": {
+			backendType: "host_gw",
+			expected:    "host-gw",
+		},
+		"builtin alias should be resolved case insensitively": {
+			backendType: "HostGW",
+			expected:    "host-gw",
+		},
+		"registered alias should be resolved case insensitively": {
+			backendType: "FAKE-alias",
+			expected:    "fake-canonical",
+		},
+	} {
+		if got := canonicalType(test.backendType); got != test.expected {
+			t.Errorf("%s: expected %q for %q, got %q", desc, test.expected, test.backendType, got)
+		}
+	}
+}
+
+func TestGetBackendByAlias(t *testing.T) {
+	created := registerFakeBackend("fake-aliased")
+	RegisterAlias("fake_aliased", "fake-aliased")
+	defer delete(aliases, "fake_aliased")
+
+	bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+	defer bm.Shutdown(context.Background()) // nolint: errcheck
+	for _, name := range []string{"fake-aliased", "FAKE_ALIASED", "Fake-Aliased"} {
+		if _, err := bm.GetBackend(name); err != nil {
+			t.Fatalf("failed to get backend %q: %v", name, err)
+		}
+	}
+	if *created != 1 {
+		t.Errorf("aliases should share one backend, got %d created", *created)
+	}
+	if active := bm.ActiveBackends(); len(active) != 1 || active[0] != "fake-aliased" {
+		t.Errorf("expected only the canonical backend to be active, got %v", active)
+	}
+}
+
+func TestStats(t *testing.T) {
+	registerFakeBackend("fake-stats")
+	RegisterWithConfig("fake-stats-failing", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		return nil, errors.New("failed to create")
+	})
+
+	for desc, test := range map[string]struct {
+		requests []string
+		expected Stats
+	}{
+		"no request": {
+			expected: Stats{Requests: map[string]uint64{}},
+		},
+		"repeated requests should be counted by canonical type": {
+			requests: []string{"fake-stats", "FAKE-STATS", "fake-stats"},
+			expected: Stats{
+				Requests: map[string]uint64{"fake-stats": 3},
+				Active:   1,
+			},
+		},
+		"unknown backend type should be counted as error": {
+			requests: []string{"fake-stats", "fake-unknown"},
+			expected: Stats{
+				Requests: map[string]uint64{"fake-stats": 1, "fake-unknown": 1},
+				Active:   1,
+				Errors:   1,
+			},
+		},
+		"failed construction should be counted as error": {
+			requests: []string{"fake-stats-failing", "fake-stats-failing"},
+			expected: Stats{
+				Requests: map[string]uint64{"fake-stats-failing": 2},
+				Errors:   2,
+			},
+		},
+	} {
+		bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+		for _, name := range test.requests {
+			bm.GetBackend(name) // nolint: errcheck
+		}
+		if stats := bm.Stats(); !reflect.DeepEqual(stats, test.expected) {
+			t.Errorf("%s: expected stats %+v, got %+v", desc, test.expected, stats)
+		}
+		if err := bm.Shutdown(context.Background()); err != nil {
+			t.Errorf("%s: failed to shut down: %v", desc, err)
+		}
+	}
+}
+
+// readyBackend is ready once ready is closed.
+type readyBackend struct {
+	fakeBackend
+	ready chan struct{}
+}
+
+func (b *readyBackend) Ready() <-chan struct{} { return b.ready }
+
+func TestWaitReady(t *testing.T) {
+	registerFakeBackend("fake-no-notifier")
+	readyCh := make(chan struct{})
+	close(readyCh)
+	RegisterWithConfig("fake-ready", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		return &readyBackend{ready: readyCh}, nil
+	})
+	RegisterWithConfig("fake-not-ready", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		return &readyBackend{ready: make(chan struct{})}, nil
+	})
+
+	for desc, test := range map[string]struct {
+		backendType string
+		create      bool
+		expectErr   bool
+	}{
+		"backend without ready notification should be ready once created": {
+			backendType: "fake-no-notifier",
+			create:      true,
+		},
+		"ready backend should be ready": {
+			backendType: "fake-ready",
+			create:      true,
+		},
+		"should time out if backend is never ready": {
+			backendType: "fake-not-ready",
+			create:      true,
+			expectErr:   true,
+		},
+		"should fail if backend is not running": {
+			backendType: "fake-ready",
+			expectErr:   true,
+		},
+	} {
+		bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+		if test.create {
+			if _, err := bm.GetBackend(test.backendType); err != nil {
+				t.Fatalf("%s: failed to get backend: %v", desc, err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := bm.WaitReady(ctx, test.backendType)
+		cancel()
+		if test.expectErr != (err != nil) {
+			t.Errorf("%s: expected error %v, got %v", desc, test.expectErr, err)
+		}
+		if err := bm.Shutdown(context.Background()); err != nil {
+			t.Errorf("%s: failed to shut down: %v", desc, err)
+		}
+	}
+}
+
+func TestPendingTimeoutCounted(t *testing.T) {
+	timeout := backendInitTimeout
+	backendInitTimeout = 10 * time.Millisecond
+	defer func() { backendInitTimeout = timeout }()
+
+	unblock := make(chan struct{})
+	RegisterWithConfig("fake-slow", func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+		<-unblock
+		return &fakeBackend{}, nil
+	})
+	bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+	if _, err := bm.GetBackend("fake-slow"); err == nil {
+		t.Fatal("expected timeout waiting for the blocking constructor")
+	}
+	if stats := bm.Stats(); stats.Errors != 1 {
+		t.Errorf("expected the timeout to be counted as error, got %d errors", stats.Errors)
+	}
+
+	close(unblock)
+	if err := bm.Shutdown(context.Background()); err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+}
+
+func TestWaitReadyPending(t *testing.T) {
+	for desc, test := range map[string]struct {
+		backendType string
+		err         error
+	}{
+		"should wait for the pending backend to be created": {
+			backendType: "fake-pending-ready",
+		},
+		"should fail if the pending backend fails to be created": {
+			backendType: "fake-pending-failing",
+			err:         errors.New("failed to create"),
+		},
+	} {
+		entered, unblock := make(chan struct{}), make(chan struct{})
+		ready := make(chan struct{})
+		close(ready)
+		ctorErr := test.err
+		RegisterWithConfig(test.backendType, func(sm subnet.Manager, ei *ExternalInterface, _ json.RawMessage) (Backend, error) {
+			close(entered)
+			<-unblock
+			if ctorErr != nil {
+				return nil, ctorErr
+			}
+			return &readyBackend{ready: ready}, nil
+		})
+		bm := NewManager(context.Background(), &fakeSubnetManager{}, nil)
+		go bm.GetBackend(test.backendType) // nolint: errcheck
+		waitClosed(t, entered, desc+": constructor should be called")
+
+		waitErr := make(chan error, 1)
+		go func() {
+			waitErr <- bm.WaitReady(context.Background(), test.backendType)
+		}()
+		select {
+		case err := <-waitErr:
+			t.Fatalf("%s: WaitReady should wait for the construction, got %v", desc, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(unblock)
+		select {
+		case err := <-waitErr:
+			if err != test.err {
+				t.Errorf("%s: expected error %v, got %v", desc, test.err, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: WaitReady should return once the backend is created", desc)
+		}
+		if err := bm.Shutdown(context.Background()); err != nil {
+			t.Errorf("%s: failed to shut down: %v", desc, err)
+		}
+	}
+}